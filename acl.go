@@ -0,0 +1,249 @@
+package gouch
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PermRead   = "read"
+	PermWrite  = "write"
+	PermDelete = "delete"
+	PermAdmin  = "admin" // admin endpoints and peer endpoints, it grants all other permissions as well
+)
+
+// ACLConfig is the content of the ACL file, e.g.:
+//
+//	{"principals": [{"name": "app", "tokens": ["t0k3n"], "rules": [{"prefix": "app/", "allow": ["read", "write"]}]}],
+//	 "anonymous": [{"prefix": "public/", "allow": ["read"]}]}
+type ACLConfig struct {
+	Principals []Principal `json:"principals"`
+	Anonymous  []ACLRule   `json:"anonymous"` // rules of requests without credentials
+}
+
+// Principal is authenticated by one of its tokens ('Authorization: Bearer <token>'),
+// or by basic auth with its name and password
+type Principal struct {
+	Name     string    `json:"name"`
+	Tokens   []string  `json:"tokens,omitempty"`
+	Password string    `json:"password,omitempty"`
+	Rules    []ACLRule `json:"rules"`
+}
+
+// ACLRule grants permissions on keys starting with Prefix, an empty prefix matches all keys
+type ACLRule struct {
+	Prefix string   `json:"prefix"`
+	Allow  []string `json:"allow"`
+}
+
+type aclState struct {
+	sync.RWMutex
+	path      string
+	tokens    map[string]*Principal
+	users     map[string]*Principal
+	anonymous *Principal
+	loadedAt  time.Time
+}
+
+// can returns whether the principal has the permission on the key, nil means ACL is disabled
+func (p *Principal) can(perm, key string) bool {
+	if p == nil {
+		return true
+	}
+	for _, r := range p.Rules {
+		if !strings.HasPrefix(key, r.Prefix) {
+			continue
+		}
+		for _, a := range r.Allow {
+			if a == perm || a == PermAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canAny returns whether the principal has the permission on any key
+func (p *Principal) canAny(perm string) bool {
+	if p == nil {
+		return true
+	}
+	for _, r := range p.Rules {
+		for _, a := range r.Allow {
+			if a == perm || a == PermAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func validateRules(rules []ACLRule) error {
+	for _, r := range rules {
+		for _, a := range r.Allow {
+			switch a {
+			case PermRead, PermWrite, PermDelete, PermAdmin:
+			default:
+				return fmt.Errorf("unknown permission %q on %q", a, r.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// ReloadACL reloads the ACL file, the current rules are kept if the file is invalid
+func (n *Node) ReloadACL() error {
+	a := &n.acl
+	if a.path == "" {
+		return fmt.Errorf("ACL is not enabled")
+	}
+
+	buf, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	cfg := ACLConfig{}
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return fmt.Errorf("invalid ACL file: %v", err)
+	}
+
+	tokens, users := map[string]*Principal{}, map[string]*Principal{}
+	for i := range cfg.Principals {
+		p := &cfg.Principals[i]
+		if p.Name == "" {
+			return fmt.Errorf("principal #%d: empty name", i)
+		}
+		if users[p.Name] != nil {
+			return fmt.Errorf("principal %q: duplicated", p.Name)
+		}
+		if err := validateRules(p.Rules); err != nil {
+			return fmt.Errorf("principal %q: %v", p.Name, err)
+		}
+		for _, t := range p.Tokens {
+			if t == "" || tokens[t] != nil {
+				return fmt.Errorf("principal %q: empty or duplicated token", p.Name)
+			}
+			tokens[t] = p
+		}
+		users[p.Name] = p
+	}
+	if err := validateRules(cfg.Anonymous); err != nil {
+		return fmt.Errorf("anonymous: %v", err)
+	}
+
+	a.Lock()
+	a.tokens, a.users = tokens, users
+	a.anonymous = &Principal{Rules: cfg.Anonymous}
+	a.loadedAt = time.Now()
+	a.Unlock()
+	return nil
+}
+
+// authenticate returns the principal of the request, requests without credentials are anonymous.
+// It returns nil if ACL is disabled
+func (n *Node) authenticate(r *http.Request) (*Principal, error) {
+	a := &n.acl
+	if a.path == "" {
+		return nil, nil
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+	if user, pass, ok := r.BasicAuth(); ok {
+		p := a.users[user]
+		if p == nil || p.Password == "" || subtle.ConstantTimeCompare([]byte(p.Password), []byte(pass)) != 1 {
+			return nil, fmt.Errorf("invalid username or password")
+		}
+		return p, nil
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return nil, fmt.Errorf("unsupported authorization")
+		}
+		p := a.tokens[strings.TrimPrefix(auth, "Bearer ")]
+		if p == nil {
+			return nil, fmt.Errorf("invalid token")
+		}
+		return p, nil
+	}
+	return a.anonymous, nil
+}
+
+// authorize checks the permission of the request on all keys. If denied, 401 (not authenticated)
+// or 403 will be written and false returned. The returned principal is nil if ACL is disabled
+func (n *Node) authorize(w http.ResponseWriter, r *http.Request, perm string, keys ...string) (*Principal, bool) {
+	p, err := n.authenticate(r)
+	if err != nil {
+		denyRequest(w, r, http.StatusUnauthorized, err.Error())
+		return nil, false
+	}
+	for _, key := range keys {
+		if p.can(perm, key) {
+			continue
+		}
+		if p.Name == "" {
+			denyRequest(w, r, http.StatusUnauthorized, "authentication required")
+		} else {
+			denyRequest(w, r, http.StatusForbidden, fmt.Sprintf("%s: %s on %q denied", p.Name, perm, key))
+		}
+		return nil, false
+	}
+	return p, true
+}
+
+// authorizePeer authorizes requests to peer endpoints, which expose all keys. Signed requests
+// (see verifyRequest) are from peers, otherwise if ACL is enabled, the principal must be an admin,
+// peers without keys can present admin tokens, see peerTransport
+func (n *Node) authorizePeer(w http.ResponseWriter, r *http.Request) bool {
+	if n.signing() {
+		if err := n.verifyRequest(r); err != nil {
+			rejectPeer(w, r, err)
+			return false
+		}
+		return true
+	}
+	_, ok := n.authorize(w, r, PermAdmin, "")
+	return ok
+}
+
+// peerTransport presents the token of the peer ('token' param of its entry in nodes.config) in requests to it,
+// so peers with ACL enabled but no replication keys can authorize us as an admin
+type peerTransport struct {
+	n    *Node
+	base http.RoundTripper
+}
+
+func (t *peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := req.URL.Scheme + "://" + req.URL.Host
+	token := ""
+	t.n.friends.Lock()
+	for name, a := range t.n.friends.contacts {
+		if a == addr {
+			token = t.n.friends.options[name].token
+			break
+		}
+	}
+	t.n.friends.Unlock()
+
+	if token != "" && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// denyRequest writes the error, X-Error is set for protobuf clients
+func denyRequest(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if code == http.StatusUnauthorized {
+		w.Header().Add("WWW-Authenticate", `Basic realm="gouch"`)
+	}
+	w.Header().Add("X-Error", "true")
+	w.Header().Add("X-Msg", msg)
+	writeJSONCode(w, r, code, "error", true, "msg", msg)
+}
@@ -0,0 +1,155 @@
+package gouch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gouch-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acl.json")
+	ioutil.WriteFile(path, []byte(`{
+		"principals": [
+			{"name": "app", "tokens": ["t1"], "rules": [{"prefix": "app_", "allow": ["read", "write"]}]},
+			{"name": "root", "password": "pw", "rules": [{"prefix": "", "allow": ["admin"]}]}
+		],
+		"anonymous": [{"prefix": "public_", "allow": ["read"]}]
+	}`), 0644)
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	n := testNode(t, Options{Driver: "memory", Mux: mux, ACLFile: path})
+	defer closeTestNode(n)
+
+	for _, k := range []string{"app_1", "app_2", "other_1", "public_1"} {
+		n.Put(k, []byte(k), false)
+	}
+
+	do := func(path string, q url.Values, auth func(*http.Request)) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("GET", srv.URL+path+"?"+q.Encode(), nil)
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		m := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&m)
+		return resp.StatusCode, m
+	}
+	token := func(tok string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+tok) }
+	}
+	basic := func(user, pass string) func(*http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, pass) }
+	}
+
+	for _, c := range []struct {
+		path string
+		q    url.Values
+		auth func(*http.Request)
+		code int
+	}{
+		{"/get/public_1", nil, nil, 200},
+		{"/get/app_1", nil, nil, 401},
+		{"/get/app_1", nil, token("bad"), 401},
+		{"/get/app_1", nil, token("t1"), 200},
+		{"/get/other_1", nil, token("t1"), 403},
+		{"/put", url.Values{"key": {"app_3"}, "value": {"v"}}, token("t1"), 200},
+		{"/put", url.Values{"key": {"other_2"}, "value": {"v"}}, token("t1"), 403},
+		{"/delete", url.Values{"key": {"app_3"}}, token("t1"), 403},
+		{"/mget", url.Values{"key": {"app_1", "other_1"}}, token("t1"), 403},
+		{"/delete", url.Values{"key": {"other_1"}}, basic("root", "pw"), 200},
+		{"/", nil, basic("root", "bad"), 401},
+		{"/", nil, token("t1"), 403},
+		{"/", nil, basic("root", "pw"), 200},
+		{"/replicate", nil, token("t1"), 403},
+	} {
+		if code, m := do(c.path, c.q, c.auth); code != c.code {
+			t.Fatal(c.path, c.q, "expect", c.code, "got", code, m)
+		}
+	}
+
+	// Unreadable keys are filtered out and not counted
+	code, m := do("/range", url.Values{"n": {"2"}}, token("t1"))
+	if code != 200 {
+		t.Fatal(code, m)
+	}
+	data, _ := m["data"].([]interface{})
+	if len(data) != 2 || data[0].(map[string]interface{})["key"] != "app_1" || data[1].(map[string]interface{})["key"] != "app_2" {
+		t.Fatal(m)
+	}
+	// The page ends before other_1, which is not returned as the next key
+	code, m = do("/range", url.Values{"n": {"3"}}, token("t1"))
+	if data, _ := m["data"].([]interface{}); code != 200 || len(data) != 3 || m["next"] != "" {
+		t.Fatal(code, m)
+	}
+	if code, _ := do("/range", url.Values{"n": {"10"}}, basic("app", "")); code != 401 {
+		t.Fatal(code)
+	}
+
+	// Reload
+	ioutil.WriteFile(path, []byte(`{"principals": [{"name": "app", "tokens": ["t2"], "rules": [{"prefix": "", "allow": ["read"]}]}]}`), 0644)
+	if err := n.ReloadACL(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := do("/get/app_1", nil, token("t1")); code != 401 {
+		t.Fatal(code)
+	}
+	if code, _ := do("/get/other_2", nil, token("t2")); code != 200 {
+		t.Fatal(code)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"principals": [{"name": "x", "rules": [{"prefix": "", "allow": ["rw"]}]}]}`), 0644)
+	if err := n.ReloadACL(); err == nil {
+		t.Fatal("invalid permission accepted")
+	}
+	if code, _ := do("/get/other_2", nil, token("t2")); code != 200 {
+		t.Fatal("rules not kept:", code)
+	}
+}
+
+func TestACLPeerToken(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gouch-acl")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acl.json")
+	ioutil.WriteFile(path, []byte(`{"principals": [{"name": "peer", "tokens": ["tp"], "rules": [{"prefix": "", "allow": ["admin"]}]}]}`), 0644)
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	a := testNode(t, Options{Driver: "memory", Name: "a", Mux: mux, ACLFile: path})
+	defer closeTestNode(a)
+	a.Put("k", []byte("v"), false)
+
+	b := testNode(t, Options{Driver: "memory", Name: "b", Peers: "http://a@" + srv.Listener.Addr().String() + "?token=tp"})
+	defer closeTestNode(b)
+	for i := 0; ; i++ {
+		if e, err := b.Get("k"); err == nil && e.Value == "v" {
+			break
+		}
+		if i > 100 {
+			t.Fatal("not replicated")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if p := b.Peers()["a"]; strings.Contains(p, "token") {
+		t.Fatal("token exposed:", p)
+	}
+}
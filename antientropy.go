@@ -0,0 +1,392 @@
+package gouch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coyove/gouch/clock"
+	"github.com/coyove/gouch/driver"
+	"github.com/gogo/protobuf/proto"
+)
+
+// merkleDepth is the depth of hash trees, there are 1 << merkleDepth leaves
+const merkleDepth = 10
+
+// AntiEntropy controls the background repair between nodes
+type AntiEntropy struct {
+	// Interval is the interval between two background repairs with every peer, 0 disables
+	Interval time.Duration
+
+	// Window limits the repair to versions newer than now - Window, it should be shorter than
+	// the retention policy, otherwise pruned versions will be pulled back from peers.
+	// 0 means all versions, or half of the shortest retention duration if there is one
+	Window time.Duration
+}
+
+// RepairResult is the result of a repair with one peer
+type RepairResult struct {
+	Peer       string    `json:"peer"`
+	At         time.Time `json:"at"`
+	Cost       float64   `json:"cost"`
+	DiffLeaves int       `json:"diff_leaves"`
+	Missing    int       `json:"missing"`
+	Pulled     int       `json:"pulled"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type antiEntropyState struct {
+	sync.Mutex
+	AntiEntropy
+	results map[string]RepairResult
+
+	// The last built tree is cached, so consecutive requests from a peer won't rebuild it
+	tree      [][]uint64
+	treeSince int64
+	treeKeep  int
+	treeAt    time.Time
+}
+
+func (n *Node) antiEntropyWorker() {
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-time.After(n.antiEntropy.Interval):
+		}
+
+		n.friends.Lock()
+		peers := make([]string, 0, len(n.friends.contacts))
+		for name := range n.friends.contacts {
+			peers = append(peers, name)
+		}
+		n.friends.Unlock()
+
+		for _, peer := range peers {
+			if _, err := n.Repair(peer); err != nil {
+				log.Println("WARN: repair with", peer, "error:", err)
+			}
+		}
+	}
+}
+
+// repairSince returns the oldest version to be repaired
+func (n *Node) repairSince() int64 {
+	w := n.antiEntropy.Window
+	if w <= 0 {
+		for _, d := range []time.Duration{n.retention.policy.KeepDuration, n.retention.policy.TombstoneGrace} {
+			if d > 0 && (w <= 0 || d/2 < w) {
+				w = d / 2
+			}
+		}
+	}
+	if w <= 0 {
+		return 0
+	}
+	return clock.Timestamp() - int64(w/time.Second)<<20
+}
+
+func merkleLeaf(k []byte) int {
+	h := fnv.New32a()
+	h.Write(k[:bytes.IndexByte(k, 0)])
+	return int(h.Sum32() & (1<<merkleDepth - 1))
+}
+
+// scanMerkle calls fn with every version newer than since and the leaf it belongs to.
+// If keep > 0, only the latest keep versions of each key are included, like RetentionPolicy.KeepVersions,
+// so versions pruned by one node but not yet by the other will not be repaired
+func (n *Node) scanMerkle(since int64, keep int, fn func(leaf int, k []byte)) error {
+	var vers [][]byte // versions of the current key, in ascending order
+	flush := func() {
+		if keep > 0 && len(vers) > keep {
+			vers = vers[len(vers)-keep:]
+		}
+		for _, k := range vers {
+			if versionInKey(k) >= since {
+				fn(merkleLeaf(k), k)
+			}
+		}
+		vers = vers[:0]
+	}
+
+	err := n.db.Seek([]byte{}, func(k, v []byte) int {
+		if bytes.Equal(k, internalNodeName) {
+			return driver.SeekNext
+		}
+		if len(vers) > 0 && !hasCommonPrefixTill0(vers[0], k) {
+			flush()
+		}
+		vers = append(vers, append([]byte{}, k...))
+		return driver.SeekNext
+	})
+	flush()
+	return err
+}
+
+// MerkleTree returns the hash tree over versions newer than since (see scanMerkle for keep), tree[0] is the root
+// level and tree[merkleDepth] contains all leaves. A leaf hash is the xor of hashes of all versions in it
+func (n *Node) MerkleTree(since int64, keep int) ([][]uint64, error) {
+	ae := &n.antiEntropy
+	ae.Lock()
+	if ae.tree != nil && ae.treeSince == since && ae.treeKeep == keep && time.Since(ae.treeAt) < 30*time.Second {
+		defer ae.Unlock()
+		return ae.tree, nil
+	}
+	ae.Unlock()
+
+	// The tree is built without the lock, concurrent requests may build it more than once
+	leaves := make([]uint64, 1<<merkleDepth)
+	if err := n.scanMerkle(since, keep, func(leaf int, k []byte) {
+		h := fnv.New64a()
+		h.Write(k)
+		leaves[leaf] ^= h.Sum64()
+	}); err != nil {
+		return nil, err
+	}
+
+	tree := make([][]uint64, merkleDepth+1)
+	tree[merkleDepth] = leaves
+	for l := merkleDepth - 1; l >= 0; l-- {
+		tree[l] = make([]uint64, 1<<uint(l))
+		for i := range tree[l] {
+			h, buf := fnv.New64a(), make([]byte, 16)
+			binary.BigEndian.PutUint64(buf, tree[l+1][i*2])
+			binary.BigEndian.PutUint64(buf[8:], tree[l+1][i*2+1])
+			h.Write(buf)
+			tree[l][i] = h.Sum64()
+		}
+	}
+
+	ae.Lock()
+	ae.tree, ae.treeSince, ae.treeKeep, ae.treeAt = tree, since, keep, time.Now()
+	ae.Unlock()
+	return tree, nil
+}
+
+// merkleKeys returns all versions newer than since in the leaves
+func (n *Node) merkleKeys(since int64, keep int, leaves map[int]bool) ([][]byte, error) {
+	keys := [][]byte{}
+	err := n.scanMerkle(since, keep, func(leaf int, k []byte) {
+		if leaves[leaf] {
+			keys = append(keys, append([]byte{}, k...))
+		}
+	})
+	return keys, err
+}
+
+// Repair compares the hash trees with the peer and pulls versions missing locally
+func (n *Node) Repair(peer string) (res RepairResult, err error) {
+	if !n.track() {
+		return res, ErrClosed
+	}
+	defer n.jobs.Done()
+
+	start := time.Now()
+	res.Peer, res.At = peer, start
+	defer func() {
+		res.Cost = time.Since(start).Seconds()
+		if err != nil {
+			res.Error = err.Error()
+		}
+		n.antiEntropy.Lock()
+		n.antiEntropy.results[peer] = res
+		n.antiEntropy.Unlock()
+	}()
+
+	n.friends.Lock()
+	addr, filter := n.friends.contacts[peer], n.friends.options[peer].Filter
+	n.friends.Unlock()
+	if addr == "" {
+		return res, fmt.Errorf("peer %q not found", peer)
+	}
+
+	since, keep := n.repairSince(), n.retention.policy.KeepVersions
+	local, err := n.MerkleTree(since, keep)
+	if err != nil {
+		return res, err
+	}
+
+	// Descend from the root, only children of different nodes are compared
+	diff := []int{0}
+	for level := 0; level <= merkleDepth && len(diff) > 0; level++ {
+		remote, err := n.fetchMerkleLevel(addr, since, keep, level, diff)
+		if err != nil {
+			return res, err
+		}
+		if len(remote) != len(diff) {
+			return res, fmt.Errorf("invalid tree level %d from %q", level, peer)
+		}
+
+		next := []int{}
+		for i, node := range diff {
+			if remote[i] == local[level][node] {
+				continue
+			}
+			if level == merkleDepth {
+				next = append(next, node)
+			} else {
+				next = append(next, node*2, node*2+1)
+			}
+		}
+		diff = next
+	}
+	if len(diff) == 0 {
+		return res, nil
+	}
+
+	leaves, diffLeaves := "", map[int]bool{}
+	for _, i := range diff {
+		diffLeaves[i] = true
+		leaves += strconv.Itoa(i) + ","
+	}
+	res.DiffLeaves = len(diff)
+
+	q := url.Values{"since": {strconv.FormatInt(since, 10)}, "keep": {strconv.Itoa(keep)}, "leaves": {leaves}}
+	resp, err := n.client.Get(n.signedURL("GET", addr+"/antientropy/keys", q, nil))
+	if err != nil {
+		return res, err
+	}
+	remoteKeys, err := readPairs(resp)
+	if err != nil {
+		return res, err
+	}
+
+	localKeys, err := n.merkleKeys(since, keep, diffLeaves)
+	if err != nil {
+		return res, err
+	}
+	have := map[string]bool{}
+	for _, k := range localKeys {
+		have[string(k)] = true
+	}
+
+	missing := &Pairs{}
+	for _, p := range remoteKeys.Data {
+		idx := bytes.IndexByte(p.Key, 0)
+		if idx > 0 && !have[string(p.Key)] && filter.match(string(p.Key[:idx])) {
+			missing.Data = append(missing.Data, Pair{Key: p.Key})
+		}
+	}
+	res.Missing = len(missing.Data)
+	if res.Missing == 0 {
+		return res, nil
+	}
+
+	buf, _ := proto.Marshal(missing)
+	resp, err = n.client.Post(n.signedURL("POST", addr+"/antientropy/pairs", url.Values{}, buf),
+		"application/protobuf", bytes.NewReader(buf))
+	if err != nil {
+		return res, err
+	}
+	pairs, err := readPairs(resp)
+	if err != nil {
+		return res, err
+	}
+	if err := n.PutKeyParis(pairs.Data); err != nil {
+		return res, err
+	}
+
+	n.antiEntropy.Lock()
+	n.antiEntropy.tree = nil
+	n.antiEntropy.Unlock()
+	res.Pulled = len(pairs.Data)
+	return res, nil
+}
+
+// fetchMerkleLevel returns hashes of the nodes at the level of the peer's tree
+func (n *Node) fetchMerkleLevel(addr string, since int64, keep, level int, nodes []int) ([]uint64, error) {
+	q := url.Values{
+		"since": {strconv.FormatInt(since, 10)},
+		"keep":  {strconv.Itoa(keep)},
+		"level": {strconv.Itoa(level)},
+		"nodes": {joinInts(nodes)},
+	}
+	resp, err := n.client.Get(n.signedURL("GET", addr+"/antientropy/tree", q, nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res := struct {
+		Error  bool     `json:"error"`
+		Msg    string   `json:"msg"`
+		Hashes []uint64 `json:"hashes"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Error {
+		return nil, fmt.Errorf("%s", res.Msg)
+	}
+	return res.Hashes, nil
+}
+
+func joinInts(a []int) string {
+	buf := make([]byte, 0, len(a)*4)
+	for i, v := range a {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendInt(buf, int64(v), 10)
+	}
+	return string(buf)
+}
+
+// splitInts parses comma separated integers, invalid ones are ignored
+func splitInts(s string) []int {
+	res := []int{}
+	for _, v := range strings.Split(s, ",") {
+		if i, err := strconv.Atoi(v); err == nil {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+func readPairs(resp *http.Response) (*Pairs, error) {
+	buf, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.Header.Get("X-Error") != "" {
+		return nil, fmt.Errorf("%s", resp.Header.Get("X-Msg"))
+	}
+	p := &Pairs{}
+	if err := proto.Unmarshal(buf, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// getPairs returns versions of the keys, versions not found will be omitted
+func (n *Node) getPairs(keys [][]byte) (*Pairs, error) {
+	res := &Pairs{NodeInternalName: n.InternalName()}
+	err := n.db.View(func(r driver.Reader) error {
+		for _, key := range keys {
+			if bytes.IndexByte(key, 0) == -1 {
+				continue
+			}
+			k, v, err := r.Get(key)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(k, key) {
+				res.Data = append(res.Data, Pair{k, v})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
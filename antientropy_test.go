@@ -0,0 +1,59 @@
+package gouch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coyove/gouch/clock"
+)
+
+func TestRepair(t *testing.T) {
+	muxa, muxb := http.NewServeMux(), http.NewServeMux()
+	srva, srvb := httptest.NewServer(muxa), httptest.NewServer(muxb)
+	defer srva.Close()
+	defer srvb.Close()
+
+	peers := "http://a@" + srva.Listener.Addr().String() + ";http://b@" + srvb.Listener.Addr().String()
+	a := testNode(t, Options{Driver: "memory", Name: "a", Peers: peers, Mux: muxa})
+	defer closeTestNode(a)
+	b := testNode(t, Options{Driver: "memory", Name: "b", Peers: peers, Mux: muxb})
+	defer closeTestNode(b)
+
+	// Writes not logged will never be replicated
+	for _, k := range []string{"k1", "k2", "k3"} {
+		if err := b.db.Put(b.combineKeyVer(k, clock.Timestamp()), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := a.Repair("b")
+	if err != nil || res.Pulled != 3 || res.DiffLeaves == 0 || res.DiffLeaves > 3 {
+		t.Fatal(res, err)
+	}
+	for _, k := range []string{"k1", "k2", "k3"} {
+		if e, err := a.Get(k); err != nil || e.Value != k {
+			t.Fatal(k, e, err)
+		}
+	}
+
+	if res, err := a.Repair("b"); err != nil || res.Missing != 0 {
+		t.Fatal(res, err)
+	}
+	if _, err := a.Repair("c"); err == nil {
+		t.Fatal("unknown peer")
+	}
+
+	// Versions pruned by KeepVersions on a are not pulled back
+	a.retention.policy.KeepVersions = 1
+	for i := 0; i < 3; i++ {
+		k := b.combineKeyVer("x", clock.Timestamp())
+		b.db.Put(k, []byte("x"))
+		if i == 2 {
+			a.db.Put(k, []byte("x"))
+		}
+	}
+	if res, err := a.Repair("b"); err != nil || res.Missing != 0 {
+		t.Fatal(res, err)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/coyove/gouch"
+	"github.com/coyove/gouch/filelog"
+)
+
+var (
+	addr        = flag.String("l", ":8080", "node listen address")
+	datadir     = flag.String("d", "localdata", "data directory")
+	nodename    = flag.String("n", "node1", "node name")
+	nodesconfig = flag.String("c", "nodes.config", "node name")
+	drivername  = flag.String("driver", "bbolt", "storage driver: bbolt, memory, lsm")
+	keepvers    = flag.Int("keep-versions", 0, "keep at most N versions per key, 0 means unlimited")
+	keepdur     = flag.Duration("keep-duration", 0, "drop versions older than the duration, 0 means forever")
+	chainlimit  = flag.Int("append-chain-limit", 0, "compact appended values once their chains exceed N, 0 disables")
+	repairint   = flag.Duration("repair-interval", 0, "interval of anti-entropy repairs with peers, 0 disables")
+	bootstrap   = flag.String("bootstrap-from", "", "seed the new data directory with the snapshot of the peer (name or address)")
+	tlscert     = flag.String("tls-cert", "", "server certificate file, enables HTTPS")
+	tlskey      = flag.String("tls-key", "", "server private key file")
+	tlsclientca = flag.String("tls-client-ca", "", "require client certificates signed by the CA (mutual TLS)")
+	peerca      = flag.String("peer-ca", "", "CA to verify https:// peers, system roots by default")
+	peercert    = flag.String("peer-cert", "", "client certificate presented to peers, -tls-cert by default")
+	peerkey     = flag.String("peer-key", "", "client private key presented to peers, -tls-key by default")
+	aclfile     = flag.String("acl", "", "ACL file of the HTTP API, reloaded on SIGHUP, empty disables")
+	segsize     = flag.Int64("log-segment-size", 64<<20, "size of write log segments in bytes")
+	logsync     = flag.String("log-sync", "never", "fsync policy of the write log: never, always, interval")
+	logsyncint  = flag.Duration("log-sync-interval", time.Second, "fsync interval of the write log for -log-sync=interval")
+	archivedir  = flag.String("log-archive-dir", "", "move truncated write log segments into the directory instead of deleting them")
+	truncint    = flag.Duration("log-truncate-interval", 0, "interval of truncating the write log replicated by all peers, 0 disables")
+	truncmargin = flag.Duration("log-truncate-margin", time.Hour, "keep write log entries within the duration before the minimal peer checkpoint")
+	tombgrace   = flag.Duration("tombstone-grace", 0, "purge tombstones replicated by all peers after the grace period, 0 disables")
+)
+
+func main() {
+	flag.Parse()
+
+	buf, err := ioutil.ReadFile(*nodesconfig)
+	if err != nil {
+		log.Println("WARN: read nodes config error:", err)
+	}
+
+	if *peercert == "" && *peerkey == "" {
+		*peercert, *peerkey = *tlscert, *tlskey
+	}
+	peerTLS, err := gouch.PeerTLSConfig(*peerca, *peercert, *peerkey)
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	node, err := gouch.NewNode(gouch.Options{
+		Name:             *nodename,
+		Driver:           *drivername,
+		DataDir:          *datadir,
+		Peers:            string(buf),
+		Listen:           *addr,
+		Mux:              mux,
+		AppendChainLimit: *chainlimit,
+		BootstrapFrom:    *bootstrap,
+		PeerTLS:          peerTLS,
+		ACLFile:          *aclfile,
+		LogTruncation:    gouch.LogTruncation{Interval: *truncint, Margin: *truncmargin},
+		AntiEntropy:      gouch.AntiEntropy{Interval: *repairint},
+		Retention: gouch.RetentionPolicy{
+			KeepVersions:   *keepvers,
+			KeepDuration:   *keepdur,
+			TombstoneGrace: *tombgrace,
+		},
+		Log: filelog.Options{
+			SegmentSize:  *segsize,
+			ArchiveDir:   *archivedir,
+			Sync:         *logsync,
+			SyncInterval: *logsyncint,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if *aclfile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := node.ReloadACL(); err != nil {
+					log.Println("WARN: reload ACL error:", err)
+				} else {
+					log.Println("ACL reloaded")
+				}
+			}
+		}()
+	}
+
+	if *tlscert != "" {
+		cfg, err := gouch.ServerTLSConfig(*tlscert, *tlskey, *tlsclientca)
+		if err != nil {
+			panic(err)
+		}
+		srv := &http.Server{Addr: *addr, Handler: mux, TLSConfig: cfg}
+		log.Println("Node is listening on (TLS):", *addr)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+
+	log.Println("Node is listening on:", *addr)
+	http.ListenAndServe(*addr, mux)
+}
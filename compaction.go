@@ -0,0 +1,157 @@
+package gouch
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/coyove/gouch/clock"
+	"github.com/coyove/gouch/driver"
+)
+
+// maxAppendDepth is the maximum number of appended versions getcas will walk through,
+// each of them copies the value, so AppendChainLimit should be well below it
+const maxAppendDepth = 1024
+
+// defaultAppendChainLimit is used when AppendChainLimit is not set or not below maxAppendDepth
+const defaultAppendChainLimit = 64
+
+var (
+	ErrAppendChainTooLong = fmt.Errorf("append chain too long")
+
+	errNothingToCompact = fmt.Errorf("nothing to compact")
+)
+
+// appendChainLength returns the number of appended versions on top of the latest full value of the key,
+// it stops counting after limit
+func (n *Node) appendChainLength(key string, limit int) (int, error) {
+	upper := n.upperKeyVer(key, clock.Timestamp())
+	k, _, err := n.db.Get(upper)
+	if err != nil || k == nil {
+		return 0, err
+	}
+
+	depth := 0
+	err = n.db.Seek(k, func(k, v []byte) int {
+		if !hasCommonPrefixTill0(k, upper) || !bytes.HasPrefix(v, appendUUID) {
+			return driver.SeekAbort
+		}
+		if depth++; depth > limit {
+			return driver.SeekAbort
+		}
+		return driver.SeekPrev
+	})
+	return depth, err
+}
+
+// maybeCompactAppends compacts the append chain of the key if it exceeds the limit,
+// caller should hold the lock of the key. It returns the version of the compaction, 0 if not compacted
+func (n *Node) maybeCompactAppends(key string) int64 {
+	depth, err := n.appendChainLength(key, n.appendChainLimit)
+	if err != nil {
+		log.Println("WARN: append chain length:", key, err)
+		return 0
+	}
+	if depth <= n.appendChainLimit {
+		return 0
+	}
+	ts, err := n.compactAppends(key, 0)
+	if err != nil && err != errNothingToCompact {
+		log.Println("WARN: compact appends:", key, err)
+	}
+	return ts
+}
+
+// CompactAppends materializes the appended value of the key into a new consolidated version,
+// so reads will no longer walk through the chain. The new version is written and replicated
+// like any other write, so all replicas will end up with the same value.
+// Appends from peers with older versions arriving after the compaction will be folded into
+// a new compaction when received, see foldLateAppends
+func (n *Node) CompactAppends(key string) (int64, error) {
+	if err := validateKey(key); err != nil {
+		return 0, err
+	}
+
+	unlock := n.lockKeys(key)
+	defer unlock()
+	return n.compactAppends(key, 0)
+}
+
+// compactAppends compacts the append chain of the key, compactions after late are ignored, see getcasLate.
+// Caller should hold the lock of the key
+func (n *Node) compactAppends(key string, late int64) (int64, error) {
+	tss, err := n.log.Write([][]byte{[]byte(key)}, func(ts []int64) error {
+		var v []byte
+		err := n.db.View(func(r driver.Reader) error {
+			upper := n.upperKeyVer(key, ts[0])
+			k, v0, err := r.Get(upper)
+			if err != nil {
+				return err
+			}
+			if _, compacted := splitCompacted(v0); !hasCommonPrefixTill0(k, upper) ||
+				!bytes.HasPrefix(v0, appendUUID) && !(compacted && late > 0) {
+				return errNothingToCompact
+			}
+			_, v, err = n.getcasLate(r, k, 0, late)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return n.db.Put(n.combineKeyVer(key, ts[0]), compactedValue(v))
+	})
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&n.compacted, 1)
+	return tss[0], nil
+}
+
+// foldLateAppends compacts keys again if appends replicated from peers are older than their compactions,
+// which would otherwise shadow them. Pairs should be sorted
+func (n *Node) foldLateAppends(pairs [][]byte) {
+	late := map[string]int64{}
+	for _, k := range pairs {
+		key := string(k[:bytes.IndexByte(k, 0)])
+		if _, ok := late[key]; ok {
+			continue // The oldest one is enough
+		}
+
+		shadowed := false
+		err := n.db.Seek(k, func(k2, v []byte) int {
+			if !hasCommonPrefixTill0(k2, k) {
+				return driver.SeekAbort
+			}
+			if bytes.Equal(k2, k) {
+				if !bytes.HasPrefix(v, appendUUID) {
+					return driver.SeekAbort
+				}
+				return driver.SeekNext
+			}
+			if _, compacted := splitCompacted(v); compacted {
+				shadowed = true
+				return driver.SeekAbort
+			}
+			if !bytes.HasPrefix(v, appendUUID) {
+				return driver.SeekAbort // Full values shadow older appends anyway
+			}
+			return driver.SeekNext
+		})
+		if err != nil {
+			log.Println("WARN: fold late appends:", key, err)
+			continue
+		}
+		if shadowed {
+			late[key] = versionInKey(k)
+		}
+	}
+
+	for key, ver := range late {
+		unlock := n.lockKeys(key)
+		if _, err := n.compactAppends(key, ver); err != nil && err != errNothingToCompact {
+			log.Println("WARN: fold late appends:", key, err)
+		}
+		unlock()
+	}
+}
@@ -0,0 +1,132 @@
+package gouch
+
+import (
+	"bytes"
+
+	"github.com/coyove/gouch/clock"
+	"github.com/coyove/gouch/driver"
+)
+
+// A version written with a causal context ctx supersedes all versions <= ctx, a version written
+// without one supersedes all versions before it (last writer wins). Versions not superseded
+// by any newer version are siblings, more than one sibling means the key has conflicts.
+
+// PutContext puts the value with the causal context ctx, which is the version the writer has seen
+// (usually the one returned by Get). Versions after ctx written concurrently will be kept as siblings
+func (n *Node) PutContext(key string, v []byte, ctx int64) (int64, error) {
+	return n.putContext(key, v, ctx, false)
+}
+
+// DeleteContext deletes the key with the causal context ctx, see PutContext
+func (n *Node) DeleteContext(key string, ctx int64) (int64, error) {
+	return n.putContext(key, deletionUUID, ctx, false)
+}
+
+// Resolve writes the value superseding all siblings of the key. If ctx > 0 and there are siblings after it,
+// which means the caller hasn't seen them, ErrConflict will be returned along with the latest sibling version
+func (n *Node) Resolve(key string, v []byte, ctx int64) (int64, error) {
+	return n.putContext(key, v, ctx, true)
+}
+
+func (n *Node) putContext(key string, v []byte, ctx int64, resolve bool) (int64, error) {
+	if err := validateKey(key); err != nil {
+		return 0, err
+	}
+
+	unlock := n.lockKeys(key)
+	defer unlock()
+
+	var cur int64
+	tss, err := n.log.Write([][]byte{[]byte(key)}, func(ts []int64) error {
+		if resolve {
+			sibs, err := n.siblings(n.db, key, ts[0])
+			if err != nil {
+				return err
+			}
+			for _, s := range sibs {
+				if ctx > 0 && s.Ver > ctx {
+					cur = s.Ver
+					return ErrConflict
+				}
+			}
+			if len(sibs) > 0 && sibs[0].Ver > ctx {
+				ctx = sibs[0].Ver
+			}
+		}
+		return n.db.Put(n.combineKeyVer(key, ts[0]), contextValue(v, ctx))
+	})
+	if err == ErrConflict {
+		return cur, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return tss[0], nil
+}
+
+// GetSiblings returns all siblings of the key, the latest first,
+// deleted siblings are included (marked as Deleted) unless the key has been deleted without conflicts
+func (n *Node) GetSiblings(key string) (res []Entry, err error) {
+	err = n.db.View(func(r driver.Reader) error {
+		res, err = n.siblings(r, key, clock.Timestamp())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 || (len(res) == 1 && res[0].Deleted) {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+func (n *Node) siblings(r driver.Reader, key string, now int64) ([]Entry, error) {
+	upper := n.upperKeyVer(key, now)
+	start, _, err := r.Get(upper)
+	if err != nil || start == nil {
+		return nil, err
+	}
+
+	covered := int64(-1)
+	keys := [][]byte{}
+	err = r.Seek(start, func(k, v []byte) int {
+		if !hasCommonPrefixTill0(k, upper) {
+			return driver.SeekAbort
+		}
+
+		ver := versionInKey(k)
+		if ver <= covered {
+			// Versions are sorted, so all older versions are superseded as well
+			return driver.SeekAbort
+		}
+
+		ctx := ver - 1
+		if bytes.HasPrefix(v, contextUUID) {
+			_, ctx = splitContext(v)
+		}
+		if ctx > covered {
+			covered = ctx
+		}
+		keys = append(keys, append([]byte{}, k...))
+		return driver.SeekPrev
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Entry, 0, len(keys))
+	for _, k := range keys {
+		e := Entry{}
+		k2, v, err := n.getcas(r, k, 0)
+		if err == ErrNotFound {
+			_, v, _ = r.Get(k)
+			e = createEntry(k, v, false)
+		} else if err != nil {
+			return nil, err
+		} else {
+			e = createEntry(k2, v, false)
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
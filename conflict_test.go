@@ -0,0 +1,66 @@
+package gouch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSiblings(t *testing.T) {
+	a := testNode(t, Options{Driver: "memory", Name: "a"})
+	defer closeTestNode(a)
+	b := testNode(t, Options{Driver: "memory", Name: "b"})
+	defer closeTestNode(b)
+
+	pull := func(to, from *Node) {
+		p, err := from.GetChangedKeysSince(0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := to.PutKeyParis(p.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ver, _ := a.Put("k", []byte("0"), false)
+	pull(b, a)
+
+	a.PutContext("k", []byte("1"), ver)
+	b.PutContext("k", []byte("2"), ver)
+	pull(a, b)
+	pull(b, a)
+
+	sa, err := a.GetSiblings("k")
+	if err != nil || len(sa) != 2 {
+		t.Fatal(sa, err)
+	}
+	sb, _ := b.GetSiblings("k")
+	if len(sb) != 2 || !reflect.DeepEqual(sa, sb) {
+		t.Fatal(sa, sb)
+	}
+	if e, _ := a.Get("k"); e.Value != sa[0].Value {
+		t.Fatal(e, sa)
+	}
+
+	// Stale context
+	if _, err := a.Resolve("k", []byte("12"), ver); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if _, err := a.Resolve("k", []byte("12"), sa[0].Ver); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := a.GetSiblings("k"); err != nil || len(s) != 1 || s[0].Value != "12" {
+		t.Fatal(s, err)
+	}
+
+	// Delete concurrent with a write
+	e, _ := a.Get("k")
+	a.DeleteContext("k", e.Ver)
+	a.PutContext("k", []byte("3"), e.Ver)
+	if s, err := a.GetSiblings("k"); err != nil || len(s) != 2 || !s[1].Deleted {
+		t.Fatal(s, err)
+	}
+	a.Delete("k")
+	if _, err := a.GetSiblings("k"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+}
@@ -1,14 +1,19 @@
-package main
+package gouch
 
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coyove/gouch/clock"
 	"github.com/coyove/gouch/driver"
@@ -17,6 +22,8 @@ import (
 
 var (
 	ErrNotFound = fmt.Errorf("key not found")
+	ErrConflict = fmt.Errorf("version conflict")
+	ErrClosed   = fmt.Errorf("node closed")
 )
 
 var (
@@ -24,72 +31,163 @@ var (
 	internalNodeNameLen = 8
 )
 
-type KeyValueDatabase interface {
-	// Get finds the requested key and its value, if not found, the biggest key before
-	// the requested key will and should be returned
-	// If no keys can be returned, callee should return (nil, nil, nil)
-	Get(key []byte) ([]byte, []byte, error)
+// KeyValueDatabase is the storage contract a driver should fulfill,
+// see package driver/drivertest for its conformance suite
+type KeyValueDatabase = driver.KeyValueDatabase
 
-	// Put puts the key-value pairs into the database,
-	// All key-value pairs should all be stored successfully or not
-	Put(keyvalues ...[]byte) error
+// Options configures a Node
+type Options struct {
+	// Name is the name of this node, it should be one of the names listed in Peers
+	Name string
 
-	// Delete deletes keys from the database
-	Delete(keys ...[]byte) error
+	// Driver is the storage driver name: "bbolt" (default), "memory" or "lsm"
+	Driver string
 
-	// Seek seeks the requested key and use the callback function to determine
-	// whether it should go forward (next key), backward (prev key) or quit
-	Seek(startKey []byte, cb func(k, v []byte) int) error
+	// DB, if provided, will be used as the storage and Driver will be ignored.
+	// If it doesn't implement KeyValueDatabase (View), multi-key reads like GetMany
+	// will not observe one consistent state
+	DB driver.BaseDatabase
 
-	// Close closes the database
-	Close() error
+	// DataDir is the directory where the database, log and replication states are stored
+	DataDir string
 
-	Info() map[string]interface{}
+	// Peers is the list of nodes in the cluster, in the format of nodes.config:
+	// "http://node1@127.0.0.1:8080;http://node2@127.0.0.1:8081;..."
+	// Resolvers can be listed as well, see parseResolver.
+	// Once peers are changed at runtime (see AddPeer), the membership is persisted in DataDir
+	// and replaces peers listed here on restarts, delete the 'members' file to use them again
+	Peers string
+
+	// Listen is the address the node is served on, only used for reporting
+	Listen string
+
+	// Mux, if provided, will have the node's HTTP handlers registered on it
+	Mux *http.ServeMux
+
+	// Retention controls how old versions are pruned in background, by default all versions are kept
+	Retention RetentionPolicy
+
+	// AppendChainLimit compacts an appended value into a new full version once
+	// its chain of appends exceeds the limit, default 64. Reading chains longer than
+	// 1024 fails with ErrAppendChainTooLong, so the limit can't be disabled or set above it
+	AppendChainLimit int
+
+	// PeerTLS is used to talk to 'https://' peers, see PeerTLSConfig
+	PeerTLS *tls.Config
+
+	// BootstrapFrom, if provided, seeds a new node with the snapshot of the peer (a peer name or its address)
+	BootstrapFrom string
+
+	// AntiEntropy controls the background repair with peers, disabled by default
+	AntiEntropy AntiEntropy
+
+	// Resolvers maps key prefixes to their conflict resolvers, keys not matched are LWW
+	Resolvers map[string]Resolver
+
+	// MergeFuncs are merge funcs which can be referred by name by resolvers in nodes.config
+	MergeFuncs map[string]MergeFunc
+
+	// Log controls the segments of the write log, see filelog.Options
+	Log filelog.Options
+
+	// LogTruncation controls the background truncation of the write log, disabled by default
+	LogTruncation LogTruncation
+
+	// ACLFile, if provided, enables the access control of the HTTP API with the rules in it, see ACLConfig.
+	// The file can be reloaded at runtime by ReloadACL
+	ACLFile string
 }
 
 type Node struct {
-	db           KeyValueDatabase
-	log          *filelog.Handler
-	path         string
-	driver       string
-	Name         string
-	internalName []byte
-	startAt      int64
-	friends      struct {
+	db               KeyValueDatabase
+	log              *filelog.Handler
+	path             string
+	driver           string
+	listen           string
+	client           *http.Client
+	secret           string
+	clusterSecret    string
+	Name             string
+	internalName     []byte
+	startAt          int64
+	closed           chan struct{}
+	closing          sync.Mutex
+	jobs             sync.WaitGroup // background jobs, see track
+	retention        retentionState
+	compacted        int64
+	appendChainLimit int
+	replicating      sync.Mutex
+	keyLocks         [64]sync.Mutex
+	resolvers        resolverRegistry
+	conflicts        int64
+	antiEntropy      antiEntropyState
+	logTruncation    logTruncationState
+	acl              aclState
+	friends          struct {
 		contacts map[string]string
+		options  map[string]peerOptions
 		states   map[string]*repState
 		sync.Mutex
 	}
 }
 
-func NewNode(name, driverName string, path string, friends string) (*Node, error) {
+func NewNode(opts Options) (*Node, error) {
+	path, driverName := opts.DataDir, opts.Driver
+	if driverName == "" {
+		driverName = "bbolt"
+	}
+	if opts.DB != nil {
+		driverName = "custom"
+	}
+
 	err := os.MkdirAll(path, 0777)
 	if err != nil {
 		return nil, err
 	}
 
 	n := &Node{
-		Name:    name,
+		Name:    opts.Name,
 		path:    path,
 		driver:  driverName,
+		listen:  opts.Listen,
 		startAt: clock.Timestamp(),
+		closed:  make(chan struct{}),
+		client:  newPeerClient(opts.PeerTLS),
+
+		appendChainLimit: opts.AppendChainLimit,
+	}
+	if n.appendChainLimit <= 0 || n.appendChainLimit >= maxAppendDepth {
+		n.appendChainLimit = defaultAppendChainLimit
 	}
+	n.client.Transport = &peerTransport{n: n, base: n.client.Transport}
 
 	switch driverName {
+	case "custom":
+		n.db = driver.WithView(opts.DB)
 	case "bbolt", "bolt":
 		n.db, err = driver.NewBBolt(filepath.Join(path, "gouch.db"))
 		if err != nil {
 			return nil, err
 		}
+	case "memory", "mem":
+		n.db = driver.NewMemory()
+	case "lsm":
+		n.db, err = driver.NewLSM(filepath.Join(path, "gouch.lsm"), driver.LSMOptions{})
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("unknown driver: %v", driverName)
 	}
 
-	n.log, err = filelog.Open(filepath.Join(path, "gouch.log"))
+	n.log, err = filelog.Open(filepath.Join(path, "gouch.log"), opts.Log)
 	if err != nil {
 		n.db.Close()
 		return nil, err
 	}
+	if records, size := n.log.Recovered(); records > 0 {
+		log.Println("WARN: discarded", records, "torn records from the tail of the log,", size, "bytes")
+	}
 
 	k, v, err := n.db.Get(internalNodeName)
 	if err != nil {
@@ -111,37 +209,172 @@ func NewNode(name, driverName string, path string, friends string) (*Node, error
 		n.internalName = v
 	}
 
-	n.readRepState(friends)
+	for prefix, r := range opts.Resolvers {
+		if err := n.resolvers.add(prefix, r); err != nil {
+			n.db.Close()
+			n.log.Close()
+			return nil, err
+		}
+	}
+	for _, entry := range strings.Split(opts.Peers, ";") {
+		if entry = strings.TrimSpace(entry); !strings.HasPrefix(entry, "resolver:") {
+			continue
+		}
+		prefix, r, err := parseResolver(entry, opts.MergeFuncs)
+		if err == nil {
+			err = n.resolvers.add(prefix, r)
+		}
+		if err != nil {
+			n.db.Close()
+			n.log.Close()
+			return nil, err
+		}
+	}
+
+	n.readRepState(opts.Peers)
+
+	if n.acl.path = opts.ACLFile; n.acl.path != "" {
+		if err := n.ReloadACL(); err != nil {
+			n.db.Close()
+			n.log.Close()
+			return nil, err
+		}
+		if !n.signing() {
+			log.Println("WARN: ACL is enabled without replication keys, peer endpoints require admins, peers should present admin tokens")
+		}
+	}
+	if (opts.Retention.TombstoneGrace > 0 || opts.LogTruncation.Interval > 0) && !n.signing() && n.acl.path == "" {
+		log.Println("WARN: tombstone GC or log truncation is enabled without replication keys or ACL, peer checkpoints can be forged")
+	}
+
+	if opts.BootstrapFrom != "" {
+		if n.log.Size() > 0 {
+			log.Println("WARN: node is not empty, bootstrap skipped")
+		} else if err := n.Bootstrap(opts.BootstrapFrom); err != nil {
+			n.db.Close()
+			n.log.Close()
+			return nil, err
+		}
+	}
+
 	for _, f := range n.friends.states {
+		f.stop = make(chan struct{})
+		n.jobs.Add(1)
 		go n.replicationWorker(f)
 	}
 
+	n.retention.policy = opts.Retention
+	if n.retention.policy.Interval <= 0 {
+		n.retention.policy.Interval = 10 * time.Minute
+	}
+	if n.retention.policy.enabled() {
+		go n.retentionWorker()
+	}
+
+	n.antiEntropy.AntiEntropy = opts.AntiEntropy
+	n.antiEntropy.results = map[string]RepairResult{}
+	if n.antiEntropy.Interval > 0 {
+		go n.antiEntropyWorker()
+	}
+
+	n.logTruncation.LogTruncation = opts.LogTruncation
+	if n.logTruncation.Interval > 0 {
+		go n.logTruncationWorker()
+	}
+
+	if opts.Mux != nil {
+		n.RegisterHandlers(opts.Mux)
+	}
+
 	return n, nil
 }
 
 func (n *Node) Put(key string, v []byte, appended bool) (int64, error) {
-	if strings.Contains(key, "\x00") {
-		return 0, fmt.Errorf("invalid key: contains '0x00'")
-	}
+	return n.put(key, v, appended, nil)
+}
 
-	if len(key) == 0 {
-		return 0, fmt.Errorf("invalid key: empty")
+// PutIf puts the value only if the latest version of the key equals ifVer,
+// ifVer = 0 means the key must not exist (or has been deleted)
+// If not, ErrConflict will be returned along with the current latest version.
+// The condition is only atomic against local writes, versions replicated from peers are not checked
+func (n *Node) PutIf(key string, v []byte, appended bool, ifVer int64) (int64, error) {
+	return n.put(key, v, appended, &ifVer)
+}
+
+func (n *Node) put(key string, v []byte, appended bool, ifVer *int64) (int64, error) {
+	if err := validateKey(key); err != nil {
+		return 0, err
 	}
 
-	keybuf := []byte(key)
+	if appended {
+		v = appendedValue(v)
+	}
 
-	ts, err := n.log.GetTimestampForKey(keybuf)
+	// The key is locked, so no other local writes of it can happen
+	// between the version check and the write
+	unlock := n.lockKeys(key)
+	defer unlock()
+
+	var cur int64
+	tss, err := n.log.Write([][]byte{[]byte(key)}, func(ts []int64) error {
+		if ifVer != nil {
+			e, err := n.Get(key)
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			if cur = e.Ver; cur != *ifVer {
+				return ErrConflict
+			}
+		}
+		return n.db.Put(n.combineKeyVer(key, ts[0]), v)
+	})
+	if err == ErrConflict {
+		return cur, err
+	}
 	if err != nil {
 		return 0, err
 	}
-
+	// The compaction supersedes the appended version, callers may use it in later PutIf
 	if appended {
-		newv := make([]byte, len(v)+16)
-		copy(newv[:], appendUUID)
-		copy(newv[16:], v)
-		v = newv
+		if ts := n.maybeCompactAppends(key); ts > 0 {
+			return ts, nil
+		}
 	}
-	return ts, n.db.Put(n.combineKeyVer(key, ts), v)
+	return tss[0], nil
+}
+
+// lockKeys locks the keys for local writes and returns the function to unlock them.
+// Keys are hashed into a fixed number of locks, which are locked in order to avoid deadlocks
+func (n *Node) lockKeys(keys ...string) func() {
+	var locked [len(n.keyLocks)]bool
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		locked[h.Sum32()%uint32(len(n.keyLocks))] = true
+	}
+	for i := range locked {
+		if locked[i] {
+			n.keyLocks[i].Lock()
+		}
+	}
+	return func() {
+		for i := range locked {
+			if locked[i] {
+				n.keyLocks[i].Unlock()
+			}
+		}
+	}
+}
+
+func validateKey(key string) error {
+	if strings.Contains(key, "\x00") {
+		return fmt.Errorf("invalid key: contains '0x00'")
+	}
+
+	if len(key) == 0 {
+		return fmt.Errorf("invalid key: empty")
+	}
+	return nil
 }
 
 func (n *Node) GetAllVersions(key string, startTimestamp int64, count int, keyOnly bool) (kvs []Entry, next int64, err error) {
@@ -150,25 +383,29 @@ func (n *Node) GetAllVersions(key string, startTimestamp int64, count int, keyOn
 		binary.BigEndian.PutUint64(upper[len(upper)-16:], uint64(startTimestamp))
 	}
 
-	prefix, skipFirst := []byte(key), false
-	err = n.db.Seek(upper, func(k, v []byte) int {
-		if !skipFirst {
-			skipFirst = true // Skip the first value as it's > upper
-			return driver.SeekPrev
-		}
-		if bytes.Equal(k, internalNodeName) {
-			return driver.SeekPrev
+	prefix := []byte(key)
+	err = n.db.View(func(r driver.Reader) error {
+		// Start from the biggest key <= upper
+		start, _, err := r.Get(upper)
+		if err != nil || start == nil {
+			return err
 		}
-		if bytes.HasPrefix(k, prefix) {
-			kvs = append(kvs, createEntry(k, v, keyOnly))
-			if len(kvs) == count+1 {
-				next = kvs[count].Ver
-				kvs = kvs[:count]
-				return driver.SeekAbort
+
+		return r.Seek(start, func(k, v []byte) int {
+			if bytes.Equal(k, internalNodeName) {
+				return driver.SeekPrev
 			}
-			return driver.SeekPrev
-		}
-		return driver.SeekAbort
+			if bytes.HasPrefix(k, prefix) {
+				kvs = append(kvs, createEntry(k, v, keyOnly))
+				if len(kvs) == count+1 {
+					next = kvs[count].Ver
+					kvs = kvs[:count]
+					return driver.SeekAbort
+				}
+				return driver.SeekPrev
+			}
+			return driver.SeekAbort
+		})
 	})
 	if err != nil {
 		return nil, 0, err
@@ -180,10 +417,41 @@ func (n *Node) Delete(key string) (int64, error) {
 	return n.Put(key, deletionUUID, false)
 }
 
+// DeleteIf deletes the key only if its latest version equals ifVer, see PutIf
+func (n *Node) DeleteIf(key string, ifVer int64) (int64, error) {
+	return n.PutIf(key, deletionUUID, false, ifVer)
+}
+
+// Purge deletes versions (db keys) directly, it may break snapshots being written, see WriteSnapshot
 func (n *Node) Purge(keys ...[]byte) error {
 	return n.db.Delete(keys...)
 }
 
+// Close closes the underlying database and log, after running background jobs finish
+func (n *Node) Close() error {
+	n.closing.Lock()
+	close(n.closed)
+	n.closing.Unlock()
+
+	n.jobs.Wait()
+	n.log.Close()
+	return n.db.Close()
+}
+
+// track registers a background job, such as PruneHistory, which Close will wait for.
+// It returns false if the node has been closed, otherwise the caller should call n.jobs.Done when finished
+func (n *Node) track() bool {
+	n.closing.Lock()
+	defer n.closing.Unlock()
+	select {
+	case <-n.closed:
+		return false
+	default:
+		n.jobs.Add(1)
+		return true
+	}
+}
+
 func (n *Node) InternalName() string {
 	return bytesToNodeName(n.internalName)
 }
@@ -200,6 +468,8 @@ func (n *Node) combineKeyVer(key string, v int64) []byte {
 }
 
 func (n *Node) Whois(internalName string) string {
+	n.friends.Lock()
+	defer n.friends.Unlock()
 	for _, v := range n.friends.states {
 		if v.NodeInternalName == internalName {
 			return v.NodeName
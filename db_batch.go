@@ -0,0 +1,58 @@
+package gouch
+
+import (
+	"fmt"
+)
+
+// Batch writes all operations in one database transaction, each operation
+// gets its own version, returned in the same order as ops
+func (n *Node) Batch(ops []BatchOp) ([]int64, error) {
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+
+	keys, names := make([][]byte, len(ops)), make([]string, len(ops))
+	for i, op := range ops {
+		if err := validateKey(op.Key); err != nil {
+			return nil, fmt.Errorf("op #%d: %v", i, err)
+		}
+		if op.Append && op.Delete {
+			return nil, fmt.Errorf("op #%d: can't append and delete at the same time", i)
+		}
+		keys[i], names[i] = []byte(op.Key), op.Key
+	}
+
+	unlock := n.lockKeys(names...)
+	defer unlock()
+
+	// All timestamps are allocated in one log write, and these records are linked
+	// so replication will never split them
+	tss, err := n.log.Write(keys, func(ts []int64) error {
+		kvs := make([][]byte, 0, len(ops)*2)
+		for i, op := range ops {
+			v := []byte(op.Value)
+			if op.Delete {
+				v = deletionUUID
+			} else if op.Append {
+				v = appendedValue(v)
+			}
+			kvs = append(kvs, n.combineKeyVer(op.Key, ts[i]), v)
+		}
+		return n.db.Put(kvs...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Like Put, the last append of each key returns the version of the compaction if any
+	compacted := map[string]bool{}
+	for i := len(ops) - 1; i >= 0; i-- {
+		if op := ops[i]; op.Append && !compacted[op.Key] {
+			compacted[op.Key] = true
+			if ts := n.maybeCompactAppends(op.Key); ts > 0 {
+				tss[i] = ts
+			}
+		}
+	}
+	return tss, nil
+}
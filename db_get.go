@@ -1,22 +1,64 @@
-package main
+package gouch
 
 import (
 	"bytes"
 	"encoding/binary"
 
 	"github.com/coyove/gouch/clock"
+	"github.com/coyove/gouch/driver"
 )
 
 func (n *Node) Get(key string) (Entry, error) {
-	start := n.combineKeyVer(key, clock.Timestamp())
-	copy(start[len(start)-8:], "\xff\xff\xff\xff\xff\xff\xff\xff")
+	return n.GetAt(key, clock.Timestamp())
+}
+
+// GetAt returns the value of the key as it was at version asOf
+// If the key matches a resolver, its siblings will be resolved by it
+func (n *Node) GetAt(key string, asOf int64) (e Entry, err error) {
+	err = n.db.View(func(r driver.Reader) error {
+		e, err = n.getResolved(r, key, asOf)
+		return err
+	})
+	return
+}
+
+// GetMany gets multiple keys in one consistent view of the database,
+// keys not found will be marked as NotFound in the results
+func (n *Node) GetMany(keys []string) ([]Entry, error) {
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+	}
 
-	k, v, err := n.getcas(start, 0)
+	res := make([]Entry, len(keys))
+	now := clock.Timestamp()
+
+	err := n.db.View(func(r driver.Reader) error {
+		for i, key := range keys {
+			e, err := n.getResolved(r, key, now)
+			if err == ErrNotFound {
+				res[i] = Entry{Key: key, NotFound: true}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			res[i] = e
+		}
+		return nil
+	})
 	if err != nil {
-		return Entry{}, err
+		return nil, err
 	}
+	return res, nil
+}
 
-	return createEntry(k, v, false), nil
+// upperKeyVer returns the biggest possible key of version v
+func (n *Node) upperKeyVer(key string, v int64) []byte {
+	k := n.combineKeyVer(key, v)
+	copy(k[len(k)-8:], "\xff\xff\xff\xff\xff\xff\xff\xff")
+	return k
 }
 
 func decbytes(key []byte) {
@@ -36,22 +78,47 @@ func hasCommonPrefixTill0(a, b []byte) bool {
 	return false
 }
 
-func (n *Node) getcas(key []byte, depth int) ([]byte, []byte, error) {
-	k, v, err := n.db.Get(key)
+func (n *Node) getcas(r driver.Reader, key []byte, depth int) ([]byte, []byte, error) {
+	return n.getcasLate(r, key, depth, 0)
+}
+
+// getcasLate is getcas, but compactions after version late are ignored as if they didn't exist,
+// late > 0 is an append arrived after them, which they don't include
+func (n *Node) getcasLate(r driver.Reader, key []byte, depth int, late int64) ([]byte, []byte, error) {
+	if depth > maxAppendDepth {
+		return nil, nil, ErrAppendChainTooLong
+	}
+
+	k, v, err := r.Get(key)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	if hasCommonPrefixTill0(k, key) && len(k) > 16 {
+		v, _ = splitContext(v)
 		if bytes.Equal(v, deletionUUID) {
 			return nil, nil, ErrNotFound
 		}
 
 		k0 := k
+		if c, ok := splitCompacted(v); ok {
+			if late == 0 || versionInKey(k) < late {
+				return k, c, nil
+			}
+			k = append([]byte{}, k...)
+			decbytes(k)
+			_, prevv, err := n.getcasLate(r, k, depth+1, late)
+			if err != nil {
+				return nil, nil, err
+			}
+			return k0, prevv, nil
+		}
+
 		if bytes.HasPrefix(v, appendUUID) {
 			v = v[16:]
+			k = append([]byte{}, k...)
 			decbytes(k)
-			_, prevv, err := n.getcas(k, depth+1)
+			_, prevv, err := n.getcasLate(r, k, depth+1, late)
 			if err != nil {
 				if err == ErrNotFound {
 					return k0, v, nil
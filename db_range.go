@@ -1,4 +1,4 @@
-package main
+package gouch
 
 import (
 	"bytes"
@@ -8,63 +8,100 @@ import (
 	"github.com/coyove/gouch/driver"
 )
 
-func (n *Node) rangePartial(key, endKey string, count int, dir int, keyOnly bool) (
+func (n *Node) rangePartial(key, endKey string, count int, dir int, keyOnly bool, now int64) (
 	kvs []Entry,
 	next string,
 	ended bool,
 	err error,
 ) {
 	start, upper := getKeyBounds(key, 0)
-	if dir == driver.SeekPrev {
-		start = upper
-	}
+	m, keys, appended := map[string]Entry{}, []string{}, map[string][]byte{}
+
+	err = n.db.View(func(r driver.Reader) error {
+		if dir == driver.SeekPrev {
+			// Start from the biggest key <= upper
+			k, _, err := r.Get(upper)
+			if err != nil || k == nil {
+				return err
+			}
+			start = k
+		}
 
-	m, keys := map[string]Entry{}, []string{}
-	now := clock.Timestamp()
-	shouldSkipFirst := dir == driver.SeekPrev
+		if err := r.Seek(start, func(k, v []byte) int {
+			if bytes.Equal(k, internalNodeName) {
+				return dir
+			}
 
-	err = n.db.Seek(start, func(k, v []byte) int {
-		if shouldSkipFirst {
-			shouldSkipFirst = false
-			return dir
-		}
+			kv := createEntry(k, v, keyOnly)
+			key := kv.Key
+			if endKey != "" && strings.Compare(key, endKey) == dir {
+				next = key
+				ended = true
+				return driver.SeekAbort
+			}
 
-		if bytes.Equal(k, internalNodeName) {
-			return dir
-		}
+			upper := n.upperKeyVer(key, now)
 
-		kv := createEntry(k, v, keyOnly)
-		key := kv.Key
-		if endKey != "" && strings.Compare(key, endKey) == dir {
-			next = key
-			ended = true
-			return driver.SeekAbort
-		}
+			if bytes.Compare(k, upper) <= 0 { // Future keys (>0) will not be stored
+				if _, ok := m[key]; !ok {
+					keys = append(keys, key)
+				}
 
-		upper := n.combineKeyVer(key, now)
-		copy(upper[len(upper)-8:], "\xff\xff\xff\xff\xff\xff\xff\xff")
+				if _, ok := m[key]; !ok || dir == driver.SeekNext {
+					m[key] = kv
+					if kv.Append {
+						appended[key] = append([]byte{}, k...)
+					}
+				}
+			}
 
-		if bytes.Compare(k, upper) <= 0 { // Future keys (>0) will not be stored
-			if _, ok := m[key]; !ok {
-				keys = append(keys, key)
+			if len(keys) >= count+1 {
+				next = keys[count]
+				keys = keys[:count]
+				return driver.SeekAbort
 			}
 
-			if dir == driver.SeekNext {
-				m[key] = kv
-			} else {
-				if _, ok := m[key]; !ok {
-					m[key] = kv
+			return dir
+		}); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if res := n.resolvers.match(key); res != nil {
+				sibs, err := n.siblings(r, key, now)
+				if err != nil {
+					return err
+				}
+				e, err := n.resolve(res, sibs)
+				if err == ErrNotFound {
+					e = m[key]
+					e.Value, e.ValueLen, e.Deleted = "", 0, true
+				} else if err != nil {
+					return err
+				}
+				if keyOnly {
+					e.Value = ""
 				}
+				m[key] = e
 			}
 		}
 
-		if len(keys) >= count+1 {
-			next = keys[count]
-			keys = keys[:count]
-			return driver.SeekAbort
+		if keyOnly {
+			return nil
 		}
 
-		return dir
+		// Seek only gives us the last appended part of values, resolve the whole chains
+		for _, key := range keys {
+			if !m[key].Append || n.resolvers.match(key) != nil {
+				continue
+			}
+			k, v, err := n.getcas(r, appended[key], 0)
+			if err != nil {
+				return err
+			}
+			m[key] = createEntry(k, v, false)
+		}
+		return nil
 	})
 
 	if err != nil {
@@ -78,23 +115,33 @@ func (n *Node) rangePartial(key, endKey string, count int, dir int, keyOnly bool
 }
 
 func (n *Node) Range(key, endKey string, count int, keyOnly, includeDeleted, desc bool) (kvs []Entry, next string, err error) {
+	return n.RangeAt(key, endKey, count, keyOnly, includeDeleted, desc, clock.Timestamp())
+}
+
+// RangeAt returns keys and their values as they were at version asOf
+func (n *Node) RangeAt(key, endKey string, count int, keyOnly, includeDeleted, desc bool, asOf int64) (kvs []Entry, next string, err error) {
+	return n.rangeAt(key, endKey, count, keyOnly, includeDeleted, desc, asOf, nil)
+}
+
+// rangeAt is RangeAt with keys filtered by allow (if not nil), filtered keys are not counted nor returned as next
+func (n *Node) rangeAt(key, endKey string, count int, keyOnly, includeDeleted, desc bool, asOf int64, allow func(string) bool) (kvs []Entry, next string, err error) {
 	dir := driver.SeekNext
 	if desc {
 		dir = driver.SeekPrev
 	}
 
 	next = key
+	ended := false
 	for len(kvs) < count {
 		partial := []Entry{}
-		ended := false
-		partial, next, ended, err = n.rangePartial(next, endKey, count-len(kvs), dir, keyOnly)
+		partial, next, ended, err = n.rangePartial(next, endKey, count-len(kvs), dir, keyOnly, asOf)
 
 		if err != nil {
 			return nil, "", err
 		}
 
 		for _, r := range partial {
-			if !r.Deleted || includeDeleted {
+			if (!r.Deleted || includeDeleted) && (allow == nil || allow(r.Key)) {
 				kvs = append(kvs, r)
 			}
 		}
@@ -104,5 +151,15 @@ func (n *Node) Range(key, endKey string, count int, keyOnly, includeDeleted, des
 		}
 	}
 
+	// next must not leak keys filtered out, skip to the next allowed one
+	for allow != nil && next != "" && !ended && !allow(next) {
+		if _, next, ended, err = n.rangePartial(next, endKey, 1, dir, true, asOf); err != nil {
+			return nil, "", err
+		}
+	}
+	if allow != nil && ended {
+		next = "" // It is beyond endKey
+	}
+
 	return kvs, next, nil
 }
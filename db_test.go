@@ -0,0 +1,422 @@
+package gouch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coyove/gouch/clock"
+	"github.com/coyove/gouch/driver"
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestPutIf(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	n := testNode(t, Options{Driver: "memory", Mux: mux})
+	defer closeTestNode(n)
+
+	ver, err := n.PutIf("counter", []byte("0"), false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := n.PutIf("counter", []byte("0"), false, 0); err != ErrConflict || cur != ver {
+		t.Fatal(cur, err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; {
+				e, err := n.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c, _ := strconv.Atoi(e.Value)
+				if _, err := n.PutIf("counter", []byte(strconv.Itoa(c+1)), false, e.Ver); err == nil {
+					i++
+				} else if err != ErrConflict {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if e, _ := n.Get("counter"); e.Value != "400" {
+		t.Fatal(e)
+	}
+
+	e, _ := n.Get("counter")
+	if _, err := n.DeleteIf("counter", e.Ver-1); err != ErrConflict {
+		t.Fatal(err)
+	}
+	if _, err := n.DeleteIf("counter", e.Ver); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.PutIf("counter", []byte("0"), false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/put?key=counter&value=1&if_ver=x", "/delete?key=counter&if_ver=x"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatal(path, resp.StatusCode)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	n := testNode(t, Options{Driver: "memory"})
+	defer closeTestNode(n)
+
+	n.Put("c", []byte("old"), false)
+	n.Put("d", []byte("hello"), false)
+
+	vers, err := n.Batch([]BatchOp{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2"},
+		{Key: "c", Delete: true},
+		{Key: "d", Value: " world", Append: true},
+	})
+	if err != nil || len(vers) != 4 {
+		t.Fatal(vers, err)
+	}
+
+	for k, v := range map[string]string{"a": "1", "b": "2", "d": "hello world"} {
+		if e, err := n.Get(k); err != nil || e.Value != v {
+			t.Fatal(k, e, err)
+		}
+	}
+	if _, err := n.Get("c"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	if _, err := n.Batch([]BatchOp{{Key: "e", Value: "1"}, {Key: "", Value: "2"}}); err == nil {
+		t.Fatal("empty key accepted")
+	}
+	if _, err := n.Get("e"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	// Replication should never split a batch
+	p, err := n.GetChangedKeysSince(0, 3)
+	if err != nil || len(p.Data) != 6 {
+		t.Fatal(p, err)
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	n := testNode(t, Options{Driver: "bbolt"})
+	defer closeTestNode(n)
+
+	n.Put("a", []byte("1"), false)
+	n.Put("b", []byte("2"), false)
+	n.Put("b", []byte("3"), true)
+	n.Put("c", []byte("4"), false)
+	n.Delete("c")
+
+	res, err := n.GetMany([]string{"a", "b", "c", "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Value != "1" || res[1].Value != "23" || !res[2].NotFound || !res[3].NotFound || res[3].Key != "d" {
+		t.Fatal(res)
+	}
+	if _, err := n.GetMany([]string{"a", ""}); err == nil {
+		t.Fatal("invalid key accepted")
+	}
+}
+
+// baseDatabase hides View of the underlying driver, like drivers written before it was introduced
+type baseDatabase struct {
+	driver.BaseDatabase
+}
+
+func TestCustomDriverWithoutView(t *testing.T) {
+	n := testNode(t, Options{DB: baseDatabase{driver.NewMemory()}})
+	defer closeTestNode(n)
+
+	n.Put("a", []byte("1"), false)
+	n.Put("a", []byte("2"), true)
+	if res, err := n.GetMany([]string{"a", "b"}); err != nil || res[0].Value != "12" || !res[1].NotFound {
+		t.Fatal(res, err)
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	n := testNode(t, Options{Driver: "memory", Mux: mux})
+	defer closeTestNode(n)
+
+	v1, _ := n.Put("a", []byte("1"), false)
+	v2, _ := n.Put("a", []byte("2"), true)
+	v3, _ := n.Put("b", []byte("x"), false)
+	v4, _ := n.Delete("a")
+	v5, _ := n.Put("a", []byte("3"), false)
+
+	for ver, exp := range map[int64]string{v1 - 1: "", v1: "1", v2: "12", v3: "12", v4: "", v5: "3"} {
+		e, err := n.GetAt("a", ver)
+		if exp == "" && err != ErrNotFound || exp != "" && e.Value != exp {
+			t.Fatal(ver, e, err)
+		}
+	}
+
+	expect := func(res []Entry, kvs ...string) {
+		t.Helper()
+		if len(res)*2 != len(kvs) {
+			t.Fatal(res)
+		}
+		for i, e := range res {
+			if e.Key != kvs[i*2] || e.Value != kvs[i*2+1] {
+				t.Fatal(res)
+			}
+		}
+	}
+
+	res, _, _ := n.RangeAt("", "", 10, false, false, false, v2)
+	expect(res, "a", "12")
+	res, _, _ = n.RangeAt("", "", 10, false, false, false, v3)
+	expect(res, "a", "12", "b", "x")
+	res, _, _ = n.RangeAt("", "", 10, false, false, false, v4)
+	expect(res, "b", "x")
+	res, _, _ = n.RangeAt("", "", 10, false, true, false, v4)
+	expect(res, "a", "", "b", "x")
+	res, _, _ = n.RangeAt("b", "", 10, false, false, true, v3)
+	expect(res, "b", "x", "a", "12")
+	res, _, _ = n.Range("", "", 10, false, false, false)
+	expect(res, "a", "3", "b", "x")
+
+	for _, path := range []string{"/get/a?as_of=x", "/range?n=10&as_of=x"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatal(path, resp.StatusCode)
+		}
+	}
+
+	vers, _, _ := n.GetAllVersions("b", 0, 10, false)
+	if len(vers) != 1 || vers[0].Ver != v3 {
+		t.Fatal(vers)
+	}
+
+	// Appended versions replicated from peers are stored under their names,
+	// which sort after the name of n2
+	n2 := testNode(t, Options{Driver: "memory", Name: "test2"})
+	defer closeTestNode(n2)
+	n2.internalName = make([]byte, internalNodeNameLen)
+	p, _ := n.GetChangedKeysSince(0, 100)
+	if err := n2.PutKeyParis(p.Data); err != nil {
+		t.Fatal(err)
+	}
+	res, _, _ = n2.RangeAt("", "", 10, false, false, false, v3)
+	expect(res, "a", "12", "b", "x")
+}
+
+func TestCompactAppends(t *testing.T) {
+	n := testNode(t, Options{Driver: "memory", AppendChainLimit: 3})
+	defer closeTestNode(n)
+	n2 := testNode(t, Options{Driver: "memory", Name: "test2"})
+	defer closeTestNode(n2)
+
+	n.Put("a", []byte("0"), false)
+	expect := "0"
+	for i := 1; i < 10; i++ {
+		n.Put("a", []byte{'0' + byte(i)}, true)
+		expect += string('0' + byte(i))
+	}
+
+	if e, err := n.Get("a"); err != nil || e.Value != expect || e.Append {
+		t.Fatal(e, err)
+	}
+	if depth, _ := n.appendChainLength("a", 100); depth > 3 {
+		t.Fatal(depth)
+	}
+	if n.compacted == 0 {
+		t.Fatal(n.compacted)
+	}
+
+	p, err := n.GetChangedKeysSince(0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n2.PutKeyParis(p.Data); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := n2.Get("a"); err != nil || e.Value != expect {
+		t.Fatal(e, err)
+	}
+
+	if _, err := n.CompactAppends("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.CompactAppends("a"); err != errNothingToCompact {
+		t.Fatal(err)
+	}
+	if e, err := n.Get("a"); err != nil || e.Value != expect {
+		t.Fatal(e, err)
+	}
+}
+
+func TestAppendChainDefaultLimit(t *testing.T) {
+	n := testNode(t, Options{Driver: "memory"})
+	defer closeTestNode(n)
+
+	for i := 0; i < maxAppendDepth+100; i++ {
+		if _, err := n.Put("a", []byte("x"), i > 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e, err := n.Get("a"); err != nil || len(e.Value) != maxAppendDepth+100 {
+		t.Fatal(len(e.Value), err)
+	}
+}
+
+func TestCompactAppendsLate(t *testing.T) {
+	n := testNode(t, Options{Driver: "memory", AppendChainLimit: 3})
+	defer closeTestNode(n)
+	x := testNode(t, Options{Driver: "memory", Name: "x"})
+	defer closeTestNode(x)
+
+	n.Put("a", []byte("0"), false)
+	p, _ := n.GetChangedKeysSince(0, 100)
+	x.PutKeyParis(p.Data)
+	x.Put("a", []byte("x"), true)
+
+	var ver int64
+	for i := 1; i < 10; i++ {
+		ver, _ = n.Put("a", []byte{'0' + byte(i)}, true)
+	}
+	if n.compacted == 0 {
+		t.Fatal(n.compacted)
+	}
+
+	// The returned version is the latest one even if compacted
+	if _, err := n.PutIf("a", []byte("!"), true, ver); err != nil {
+		t.Fatal(err)
+	}
+
+	// The append from x is older than the compactions, but still counted
+	p, _ = x.GetChangedKeysSince(0, 100)
+	if err := n.PutKeyParis(p.Data); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := n.Get("a"); err != nil || e.Value != "0x123456789!" {
+		t.Fatal(e, err)
+	}
+	if res, _, _ := n.Range("", "", 10, false, false, false); len(res) != 1 || res[0].Value != "0x123456789!" {
+		t.Fatal(res)
+	}
+}
+
+func TestTransitiveReplication(t *testing.T) {
+	a := testNode(t, Options{Driver: "memory", Name: "a"})
+	defer closeTestNode(a)
+	b := testNode(t, Options{Driver: "memory", Name: "b"})
+	defer closeTestNode(b)
+	c := testNode(t, Options{Driver: "memory", Name: "c"})
+	defer closeTestNode(c)
+
+	pull := func(to, from *Node, since int64) {
+		p, err := from.GetChangedKeysSince(since, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := to.PutKeyParis(p.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.Put("k", []byte("1"), false)
+	b.Put("k2", []byte("2"), false)
+	pull(b, a, 0)
+	pull(c, b, 0)
+
+	for k, v := range map[string]string{"k": "1", "k2": "2"} {
+		if e, err := c.Get(k); err != nil || e.Value != v {
+			t.Fatal(k, e, err)
+		}
+	}
+
+	// Pairs already present will not be logged again
+	pull(a, c, 0)
+	size := a.log.Size()
+	pull(a, c, 0)
+	pull(a, b, 0)
+	if a.log.Size() != size {
+		t.Fatal(a.log.Size(), size)
+	}
+	if e, err := a.Get("k2"); err != nil || e.Value != "2" {
+		t.Fatal(e, err)
+	}
+}
+
+func TestLongPollReplicate(t *testing.T) {
+	mux := http.NewServeMux()
+	n := testNode(t, Options{Driver: "memory", Mux: mux})
+	defer closeTestNode(n)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		n.Put("a", []byte("1"), false)
+	}()
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "/replicate?wait=10s&ver=" + strconv.FormatInt(clock.Timestamp(), 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	p := &Pairs{}
+	if err := proto.Unmarshal(buf, p); err != nil || len(p.Data) != 1 {
+		t.Fatal(p, err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal(time.Since(start))
+	}
+}
+
+func TestFilteredReplication(t *testing.T) {
+	n := testNode(t, Options{Driver: "memory"})
+	defer closeTestNode(n)
+
+	for i := 0; i < 10; i++ {
+		n.Put("t1/"+strconv.Itoa(i), []byte("v"), false)
+		n.Put("t2/"+strconv.Itoa(i), []byte("v"), false)
+	}
+
+	filter := ReplicationFilter{Include: []string{"t1/"}, Exclude: []string{"t1/5"}}
+	p, err := n.GetFilteredKeysSince(0, 100, filter)
+	if err != nil || len(p.Data) != 9 {
+		t.Fatal(p, err)
+	}
+
+	// Checkpoints advance past filtered entries
+	ts, _ := n.Put("t2/x", []byte("v"), false)
+	p, err = n.GetFilteredKeysSince(p.Next, 100, filter)
+	if err != nil || len(p.Data) != 0 || p.Next != ts+1 {
+		t.Fatal(p, ts, err)
+	}
+}
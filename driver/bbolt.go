@@ -72,48 +72,68 @@ func (db *bboltDatabase) Delete(keys ...[]byte) error {
 	})
 }
 
-func (db *bboltDatabase) Get(k []byte) ([]byte, []byte, error) {
-	var v []byte
-	err := db.db.View(func(tx *bbolt.Tx) error {
-		c := tx.Bucket(bkd).Cursor()
-
-		sk, sv := c.Seek(k)
-
-		if !bytes.Equal(sk, k) {
-			sk, sv = c.Prev()
-		}
-
-		v = append([]byte{}, sv...)
-		k = append([]byte{}, sk...)
-		return nil
+func (db *bboltDatabase) Get(k []byte) (rk []byte, rv []byte, err error) {
+	err = db.db.View(func(tx *bbolt.Tx) error {
+		rk, rv, err = bboltReader{tx}.Get(k)
+		return err
 	})
-	return k, v, err
+	return
 }
 
 func (db *bboltDatabase) Seek(startKey []byte, cb func(k, v []byte) int) error {
 	return db.db.View(func(tx *bbolt.Tx) error {
-		c := tx.Bucket(bkd).Cursor()
+		return bboltReader{tx}.Seek(startKey, cb)
+	})
+}
 
-		k, v := c.Seek(startKey)
-		if len(k) == 0 {
+func (db *bboltDatabase) View(fn func(r Reader) error) error {
+	return db.db.View(func(tx *bbolt.Tx) error {
+		return fn(bboltReader{tx})
+	})
+}
+
+type bboltReader struct {
+	tx *bbolt.Tx
+}
+
+func (r bboltReader) Get(k []byte) ([]byte, []byte, error) {
+	c := r.tx.Bucket(bkd).Cursor()
+
+	sk, sv := c.Seek(k)
+
+	if !bytes.Equal(sk, k) {
+		sk, sv = c.Prev()
+	}
+
+	if sk == nil {
+		return nil, nil, nil
+	}
+
+	return append([]byte{}, sk...), append([]byte{}, sv...), nil
+}
+
+func (r bboltReader) Seek(startKey []byte, cb func(k, v []byte) int) error {
+	c := r.tx.Bucket(bkd).Cursor()
+
+	k, v := c.Seek(startKey)
+	if len(k) == 0 {
+		return nil
+	}
+
+	for todo := cb(k, v); ; todo = cb(k, v) {
+		switch todo {
+		case SeekPrev:
+			k, v = c.Prev()
+		case SeekNext:
+			k, v = c.Next()
+		default:
 			return nil
 		}
 
-		for todo := cb(k, v); ; todo = cb(k, v) {
-			switch todo {
-			case SeekPrev:
-				k, v = c.Prev()
-			case SeekNext:
-				k, v = c.Next()
-			default:
-				return nil
-			}
-
-			if len(k) == 0 {
-				return nil
-			}
+		if len(k) == 0 {
+			return nil
 		}
-	})
+	}
 }
 
 func (db *bboltDatabase) Info() map[string]interface{} {
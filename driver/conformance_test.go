@@ -0,0 +1,70 @@
+package driver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coyove/gouch/driver"
+	"github.com/coyove/gouch/driver/drivertest"
+)
+
+func TestBBoltConformance(t *testing.T) {
+	drivertest.Run(t, drivertest.Config{
+		Open: func(t *testing.T) driver.KeyValueDatabase {
+			dir, err := ioutil.TempDir("", "bbolt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir) // bbolt keeps the file opened
+			db, err := driver.NewBBolt(filepath.Join(dir, "test.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		BadPair: func() ([]byte, []byte) {
+			return make([]byte, 32769), nil // bbolt.MaxKeySize + 1
+		},
+	})
+}
+
+func TestMemoryConformance(t *testing.T) {
+	drivertest.Run(t, drivertest.Config{
+		Open: func(t *testing.T) driver.KeyValueDatabase {
+			return driver.NewMemory()
+		},
+		BadPair: func() ([]byte, []byte) {
+			return make([]byte, driver.MaxKeySize+1), nil
+		},
+	})
+}
+
+func TestLSMConformance(t *testing.T) {
+	dirs := []string{}
+	defer func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	drivertest.Run(t, drivertest.Config{
+		Open: func(t *testing.T) driver.KeyValueDatabase {
+			dir, err := ioutil.TempDir("", "lsm")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dirs = append(dirs, dir)
+			// Tiny memtables to have keys spread across segments
+			db, err := driver.NewLSM(dir, driver.LSMOptions{MemtableSize: 2048, CompactAt: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		BadPair: func() ([]byte, []byte) {
+			return make([]byte, driver.MaxKeySize+1), nil
+		},
+	})
+}
@@ -0,0 +1,337 @@
+// Package drivertest provides a conformance suite for driver.KeyValueDatabase implementations
+package drivertest
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coyove/gouch/driver"
+)
+
+// Config describes the driver under test
+type Config struct {
+	// Open returns a new and empty database, it will be closed by the suite
+	Open func(t *testing.T) driver.KeyValueDatabase
+
+	// BadPair returns a key-value pair the driver is guaranteed to reject in Put,
+	// if nil, the atomic failure test will be skipped
+	BadPair func() (k, v []byte)
+}
+
+// Run runs all conformance tests against the driver
+func Run(t *testing.T, c Config) {
+	for _, test := range []struct {
+		name string
+		f    func(t *testing.T, c Config, db driver.KeyValueDatabase)
+	}{
+		{"GetEmpty", testGetEmpty},
+		{"GetFloor", testGetFloor},
+		{"GetOwnership", testGetOwnership},
+		{"PutOverwrite", testPutOverwrite},
+		{"PutAtomic", testPutAtomic},
+		{"Delete", testDelete},
+		{"SeekStart", testSeekStart},
+		{"SeekReverse", testSeekReverse},
+		{"ConcurrentReaders", testConcurrentReaders},
+		{"View", testView},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db := c.Open(t)
+			defer db.Close()
+			test.f(t, c, db)
+		})
+	}
+}
+
+func put(t *testing.T, db driver.KeyValueDatabase, kvs ...string) {
+	t.Helper()
+	p := make([][]byte, len(kvs))
+	for i := range kvs {
+		p[i] = []byte(kvs[i])
+	}
+	if err := db.Put(p...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectGet(t *testing.T, db driver.KeyValueDatabase, key, expKey, expValue string) {
+	t.Helper()
+	k, v, err := db.Get([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expKey == "" {
+		if k != nil || v != nil {
+			t.Fatalf("Get(%q): expect nothing, got %q=%q", key, k, v)
+		}
+		return
+	}
+	if string(k) != expKey || string(v) != expValue {
+		t.Fatalf("Get(%q): expect %q=%q, got %q=%q", key, expKey, expValue, k, v)
+	}
+}
+
+// seek runs Seek with directions taken from dirs, and returns all visited keys
+func seek(t *testing.T, db driver.KeyValueDatabase, start string, dirs ...int) []string {
+	t.Helper()
+	keys := []string{}
+	if err := db.Seek([]byte(start), func(k, v []byte) int {
+		keys = append(keys, string(k))
+		if len(keys) > len(dirs) {
+			return driver.SeekAbort
+		}
+		return dirs[len(keys)-1]
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func expectKeys(t *testing.T, got []string, exp ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(exp) {
+		t.Fatalf("expect keys %q, got %q", exp, got)
+	}
+}
+
+func testGetEmpty(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	expectGet(t, db, "a", "", "")
+	expectGet(t, db, "\xff\xff", "", "")
+	expectKeys(t, seek(t, db, "", driver.SeekNext))
+}
+
+func testGetFloor(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	put(t, db, "b", "1", "d", "2", "f", "3")
+
+	expectGet(t, db, "a", "", "")
+	expectGet(t, db, "", "", "")
+	expectGet(t, db, "b", "b", "1")
+	expectGet(t, db, "b\x00", "b", "1")
+	expectGet(t, db, "c", "b", "1")
+	expectGet(t, db, "d", "d", "2")
+	expectGet(t, db, "e\xff", "d", "2")
+	expectGet(t, db, "f", "f", "3")
+	expectGet(t, db, "g", "f", "3")
+	expectGet(t, db, "\xff\xff\xff", "f", "3")
+}
+
+func testGetOwnership(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	k, v := []byte("key"), []byte("value")
+	if err := db.Put(k, v); err != nil {
+		t.Fatal(err)
+	}
+	// Callee should not retain the passed slices
+	k[0], v[0] = 'x', 'x'
+	expectGet(t, db, "key", "key", "value")
+
+	// Caller can modify the returned slices
+	gk, gv, _ := db.Get([]byte("key"))
+	gk[0], gv[0] = 'x', 'x'
+	expectGet(t, db, "key", "key", "value")
+}
+
+func testPutOverwrite(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	put(t, db, "a", "1", "b", "2")
+	put(t, db, "a", "3", "", "ignored")
+	expectGet(t, db, "a", "a", "3")
+	expectGet(t, db, "b", "b", "2")
+	expectKeys(t, seek(t, db, "", driver.SeekNext, driver.SeekNext), "a", "b")
+}
+
+func testPutAtomic(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	if c.BadPair == nil {
+		t.Skip("BadPair not provided")
+	}
+
+	put(t, db, "a", "1")
+
+	bk, bv := c.BadPair()
+	if err := db.Put([]byte("a"), []byte("2"), []byte("b"), []byte("3"), bk, bv, []byte("c"), []byte("4")); err == nil {
+		t.Fatal("expect error from BadPair")
+	}
+
+	expectGet(t, db, "a", "a", "1")
+	expectGet(t, db, "b", "a", "1")
+	expectGet(t, db, "c", "a", "1")
+}
+
+func testDelete(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	put(t, db, "a", "1", "b", "2", "c", "3")
+
+	if err := db.Delete([]byte("b"), []byte("not-exist")); err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, db, "b", "a", "1")
+	expectKeys(t, seek(t, db, "", driver.SeekNext, driver.SeekNext, driver.SeekNext), "a", "c")
+
+	if err := db.Delete([]byte("a"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, db, "z", "", "")
+}
+
+func testSeekStart(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	put(t, db, "b", "1", "d", "2", "f", "3")
+
+	expectKeys(t, seek(t, db, "a", driver.SeekNext, driver.SeekNext, driver.SeekNext), "b", "d", "f")
+	expectKeys(t, seek(t, db, "c", driver.SeekPrev, driver.SeekPrev), "d", "b")
+	expectKeys(t, seek(t, db, "d", driver.SeekAbort), "d")
+	expectKeys(t, seek(t, db, "f", driver.SeekNext), "f")
+	expectKeys(t, seek(t, db, "g", driver.SeekPrev))
+}
+
+func testSeekReverse(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	kvs := []string{}
+	for i := 0; i < 10; i++ {
+		kvs = append(kvs, strconv.Itoa(i), strconv.Itoa(i*i))
+	}
+	put(t, db, kvs...)
+
+	expectKeys(t, seek(t, db, "4",
+		driver.SeekNext, driver.SeekNext, driver.SeekPrev, driver.SeekPrev, driver.SeekPrev, driver.SeekNext),
+		"4", "5", "6", "5", "4", "3", "4")
+
+	expectKeys(t, seek(t, db, "1",
+		driver.SeekPrev, driver.SeekNext, driver.SeekNext),
+		"1", "0", "1", "2")
+
+	expectKeys(t, seek(t, db, "0", driver.SeekPrev), "0")
+	expectKeys(t, seek(t, db, "9", driver.SeekNext), "9")
+
+	values := []string{}
+	db.Seek([]byte("3"), func(k, v []byte) int {
+		values = append(values, string(v))
+		if len(values) == 3 {
+			return driver.SeekAbort
+		}
+		return driver.SeekPrev
+	})
+	expectKeys(t, values, "9", "4", "1")
+}
+
+func testConcurrentReaders(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	const batch = 8
+	var (
+		wg    sync.WaitGroup
+		stop  = make(chan bool)
+		errs  = make(chan error, 16)
+		gens  = 200
+		value = bytes.Repeat([]byte("v"), 100)
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(stop)
+		for g := 0; g < gens; g++ {
+			kvs := [][]byte{}
+			for i := 0; i < batch; i++ {
+				kvs = append(kvs, []byte(fmt.Sprintf("g%04d/%d", g, i)), value)
+			}
+			if err := db.Put(kvs...); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				counts := map[string]int{}
+				if err := db.Seek([]byte("g"), func(k, v []byte) int {
+					if !bytes.Equal(v, value) {
+						errs <- fmt.Errorf("invalid value of %q: %q", k, v)
+						return driver.SeekAbort
+					}
+					counts[string(k[:5])]++
+					return driver.SeekNext
+				}); err != nil {
+					errs <- err
+					return
+				}
+				for g, c := range counts {
+					if c != batch {
+						errs <- fmt.Errorf("partial batch %s observed: %d/%d", g, c, batch)
+						return
+					}
+				}
+
+				if k, _, err := db.Get([]byte("g\xff")); err != nil {
+					errs <- err
+					return
+				} else if k != nil && !bytes.HasSuffix(k, []byte("/"+strconv.Itoa(batch-1))) {
+					errs <- fmt.Errorf("partial batch observed: %q", k)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if k, _, _ := db.Get([]byte("g\xff")); string(k) != fmt.Sprintf("g%04d/%d", gens-1, batch-1) {
+		t.Fatal("last key:", string(k))
+	}
+}
+
+func testView(t *testing.T, c Config, db driver.KeyValueDatabase) {
+	put(t, db, "a", "1", "b", "2")
+
+	written := make(chan error, 1)
+	if err := db.View(func(r driver.Reader) error {
+		k, v, err := r.Get([]byte("a"))
+		if err != nil || string(k) != "a" || string(v) != "1" {
+			return fmt.Errorf("Get: %q=%q, %v", k, v, err)
+		}
+
+		// Writers may be blocked by the view, so don't wait for it
+		go func() { written <- db.Put([]byte("a"), []byte("3"), []byte("c"), []byte("4")) }()
+		time.Sleep(50 * time.Millisecond)
+
+		if k, v, err := r.Get([]byte("a")); err != nil || string(k) != "a" || string(v) != "1" {
+			return fmt.Errorf("Get after write: %q=%q, %v", k, v, err)
+		}
+		keys := []string{}
+		if err := r.Seek([]byte("a"), func(k, v []byte) int {
+			keys = append(keys, string(k))
+			return driver.SeekNext
+		}); err != nil {
+			return err
+		}
+		expectKeys(t, keys, "a", "b")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, db, "a", "a", "3")
+	expectGet(t, db, "c", "c", "4")
+
+	if err := db.View(func(r driver.Reader) error {
+		return fmt.Errorf("view error")
+	}); err == nil || err.Error() != "view error" {
+		t.Fatal("View should return the error of fn:", err)
+	}
+}
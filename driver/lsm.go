@@ -0,0 +1,513 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	lsmValue   = 0
+	lsmDeleted = 1
+)
+
+type LSMOptions struct {
+	// MemtableSize is the size in bytes at which the memtable will be flushed into a segment, default 4M
+	MemtableSize int64
+
+	// CompactAt is the number of segments which will trigger a background compaction, default 4
+	CompactAt int
+
+	// SyncWrites makes every Put/Delete fsync the WAL before returning
+	SyncWrites bool
+}
+
+type lsmManifest struct {
+	Seq        uint64   `json:"seq"`
+	Segments   []string `json:"segments"`
+	FlushedWAL uint64   `json:"flushed_wal"`
+}
+
+// lsmDatabase is a log-structured merge tree: writes go into the WAL and the memtable,
+// full memtables are flushed into immutable sorted segments in background,
+// and segments are merged into one when there are too many of them
+type lsmDatabase struct {
+	mu         sync.RWMutex
+	flushed    *sync.Cond
+	dir        string
+	opts       LSMOptions
+	mem        *memoryDatabase
+	imm        *memoryDatabase // memtable being flushed
+	wal        *lsmWAL
+	segments   []*lsmSegment // oldest first
+	seq        uint64
+	flushedWAL uint64
+	compacting bool
+	bgErr      error
+	flushN     int
+	compactN   int
+	closing    bool // no more background jobs will be started
+	wg         sync.WaitGroup
+}
+
+func NewLSM(dir string, opts LSMOptions) (*lsmDatabase, error) {
+	if opts.MemtableSize <= 0 {
+		opts.MemtableSize = 4 << 20
+	}
+	if opts.CompactAt <= 1 {
+		opts.CompactAt = 4
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	db := &lsmDatabase{
+		dir:  dir,
+		opts: opts,
+		mem:  NewMemory(),
+	}
+	db.flushed = sync.NewCond(&db.mu)
+
+	if err := db.recover(); err != nil {
+		db.closeSegments()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *lsmDatabase) file(prefix string, seq uint64, ext string) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%s-%016x%s", prefix, seq, ext))
+}
+
+func (db *lsmDatabase) recover() error {
+	m := lsmManifest{}
+	if buf, err := ioutil.ReadFile(filepath.Join(db.dir, "MANIFEST")); err == nil {
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return fmt.Errorf("corrupted manifest: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	db.seq, db.flushedWAL = m.Seq, m.FlushedWAL
+
+	live := map[string]bool{}
+	for _, name := range m.Segments {
+		s, err := openLSMSegment(filepath.Join(db.dir, name))
+		if err != nil {
+			return err
+		}
+		db.segments = append(db.segments, s)
+		live[name] = true
+	}
+
+	files, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+
+	wals := []uint64{}
+	for _, fi := range files {
+		name := fi.Name()
+		switch {
+		case strings.HasPrefix(name, "wal-") && strings.HasSuffix(name, ".log"):
+			seq, err := strconv.ParseUint(name[4:len(name)-4], 16, 64)
+			if err != nil {
+				continue
+			}
+			if seq > db.seq {
+				db.seq = seq
+			}
+			if seq <= db.flushedWAL {
+				os.Remove(filepath.Join(db.dir, name))
+				continue
+			}
+			wals = append(wals, seq)
+		case strings.HasPrefix(name, "seg-") && !live[name]:
+			// Leftovers of unfinished flushes or compactions
+			os.Remove(filepath.Join(db.dir, name))
+		}
+	}
+	sort.Slice(wals, func(i, j int) bool { return wals[i] < wals[j] })
+
+	for _, seq := range wals {
+		if err := replayLSMWAL(db.file("wal", seq, ".log"), db.mem); err != nil {
+			return err
+		}
+	}
+
+	if db.mem.count > 0 {
+		// Flush what we have recovered, so we can start with a fresh WAL
+		db.seq++
+		s, err := writeLSMSegment(db.file("seg", db.seq, ".sst"), db.mem.iterate)
+		if err != nil {
+			return err
+		}
+		db.segments = append(db.segments, s)
+		db.mem = NewMemory()
+	}
+	if len(wals) > 0 {
+		db.flushedWAL = wals[len(wals)-1]
+	}
+	if err := db.writeManifest(); err != nil {
+		return err
+	}
+	for _, seq := range wals {
+		os.Remove(db.file("wal", seq, ".log"))
+	}
+
+	db.seq++
+	db.wal, err = openLSMWAL(db.file("wal", db.seq, ".log"), db.seq, db.opts.SyncWrites)
+	return err
+}
+
+func (db *lsmDatabase) writeManifest() error {
+	m := lsmManifest{Seq: db.seq, FlushedWAL: db.flushedWAL, Segments: []string{}}
+	for _, s := range db.segments {
+		m.Segments = append(m.Segments, filepath.Base(s.path))
+	}
+	buf, _ := json.Marshal(m)
+
+	fn := filepath.Join(db.dir, "MANIFEST")
+	f, err := os.Create(fn + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+// iterate emits all entries of a memtable in order, used when flushing it into a segment
+func (m *memoryDatabase) iterate(emit func(k []byte, deleted bool, v []byte) error) error {
+	for x := m.head.next[0]; x != nil; x = x.next[0] {
+		if err := emit(x.key, x.value[0] == lsmDeleted, x.value[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sources returns memtables and segments, newest first, caller should hold the lock
+func (db *lsmDatabase) sources() []lsmSource {
+	srcs := []lsmSource{lsmMemtable{db.mem}}
+	if db.imm != nil {
+		srcs = append(srcs, lsmMemtable{db.imm})
+	}
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		srcs = append(srcs, db.segments[i])
+	}
+	return srcs
+}
+
+// lsmFind merges all sources (newest first) and returns the first visible entry
+// in the direction, deleted keys are skipped
+func lsmFind(srcs []lsmSource, key []byte, dir int, strict bool) (lsmEntry, bool) {
+	for {
+		var best lsmEntry
+		found := false
+		for _, s := range srcs {
+			e, ok := s.find(key, dir, strict)
+			if !ok {
+				continue
+			}
+			if !found || bytes.Compare(e.key, best.key)*dir < 0 {
+				best, found = e, true
+			}
+		}
+		if !found {
+			return lsmEntry{}, false
+		}
+		if !best.deleted {
+			return best, true
+		}
+		key, strict = best.key, true
+	}
+}
+
+func (db *lsmDatabase) write(flag byte, kvs ...[]byte) error {
+	payload := bytes.Buffer{}
+	for i := 0; i < len(kvs); i += 2 {
+		if len(kvs[i]) == 0 {
+			continue
+		}
+		encodeLSMRecord(&payload, flag, kvs[i], kvs[i+1])
+	}
+	if payload.Len() == 0 {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	if db.wal == nil || db.closing {
+		return fmt.Errorf("database closed")
+	}
+
+	if db.mem.size >= db.opts.MemtableSize {
+		if err := db.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := db.wal.write(payload.Bytes()); err != nil {
+		return err
+	}
+
+	for i := 0; i < len(kvs); i += 2 {
+		if len(kvs[i]) == 0 {
+			continue
+		}
+		db.mem.put(kvs[i], append([]byte{flag}, kvs[i+1]...))
+	}
+	return nil
+}
+
+// rotate turns the memtable into an immutable one and flushes it in background,
+// caller should hold the lock
+func (db *lsmDatabase) rotate() error {
+	for db.imm != nil && db.bgErr == nil {
+		db.flushed.Wait()
+	}
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+
+	db.seq++
+	wal, err := openLSMWAL(db.file("wal", db.seq, ".log"), db.seq, db.opts.SyncWrites)
+	if err != nil {
+		return err
+	}
+	db.seq++
+
+	imm, immWAL, segSeq := db.mem, db.wal, db.seq
+	db.imm, db.mem, db.wal = imm, NewMemory(), wal
+
+	db.wg.Add(1)
+	go db.flush(imm, immWAL, segSeq)
+	return nil
+}
+
+func (db *lsmDatabase) flush(imm *memoryDatabase, wal *lsmWAL, seq uint64) {
+	defer db.wg.Done()
+
+	// imm is not changing anymore, so it is safe to read without the lock
+	s, err := writeLSMSegment(db.file("seg", seq, ".sst"), imm.iterate)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer db.flushed.Broadcast()
+
+	if err != nil {
+		db.bgErr = fmt.Errorf("flush: %v", err)
+		return
+	}
+
+	db.segments = append(db.segments, s)
+	db.flushedWAL = wal.seq
+	if err := db.writeManifest(); err != nil {
+		db.bgErr = fmt.Errorf("flush: %v", err)
+		return
+	}
+
+	wal.close()
+	os.Remove(wal.path)
+	db.imm = nil
+	db.flushN++
+
+	if len(db.segments) >= db.opts.CompactAt && !db.compacting && !db.closing {
+		db.compacting = true
+		db.seq++
+		db.wg.Add(1)
+		go db.compact(append([]*lsmSegment{}, db.segments...), db.seq)
+	}
+}
+
+// compact merges segments into one, since they are always the oldest ones,
+// deleted keys can be dropped safely
+func (db *lsmDatabase) compact(inputs []*lsmSegment, seq uint64) {
+	defer db.wg.Done()
+
+	srcs := make([]lsmSource, len(inputs))
+	for i := range inputs {
+		srcs[len(inputs)-1-i] = inputs[i]
+	}
+
+	s, err := writeLSMSegment(db.file("seg", seq, ".sst"), func(emit func(k []byte, deleted bool, v []byte) error) error {
+		e, ok := lsmFind(srcs, nil, SeekNext, false)
+		for ok {
+			v, err := e.load()
+			if err != nil {
+				return err
+			}
+			if err := emit(e.key, false, v); err != nil {
+				return err
+			}
+			e, ok = lsmFind(srcs, e.key, SeekNext, true)
+		}
+		return nil
+	})
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.compacting = false
+
+	if err != nil {
+		db.bgErr = fmt.Errorf("compaction: %v", err)
+		return
+	}
+
+	old := db.segments
+	db.segments = append([]*lsmSegment{s}, db.segments[len(inputs):]...)
+	if err := db.writeManifest(); err != nil {
+		db.segments = old
+		s.close()
+		os.Remove(s.path)
+		db.bgErr = fmt.Errorf("compaction: %v", err)
+		return
+	}
+
+	for _, in := range inputs {
+		in.close()
+		os.Remove(in.path)
+	}
+	db.compactN++
+}
+
+func (db *lsmDatabase) closeSegments() {
+	for _, s := range db.segments {
+		s.close()
+	}
+	db.segments = nil
+}
+
+func (db *lsmDatabase) Close() error {
+	// Background jobs are only started under the lock, so none can be added while waiting
+	db.mu.Lock()
+	db.closing = true
+	db.mu.Unlock()
+	db.wg.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.wal == nil {
+		return nil
+	}
+	err := db.wal.close()
+	db.wal = nil
+	db.closeSegments()
+	return err
+}
+
+func (db *lsmDatabase) Put(kvs ...[]byte) error {
+	if len(kvs)%2 != 0 {
+		panic("odd")
+	}
+	if err := checkKeys(kvs); err != nil {
+		return err
+	}
+	return db.write(lsmValue, kvs...)
+}
+
+func (db *lsmDatabase) Delete(keys ...[]byte) error {
+	kvs := make([][]byte, 0, len(keys)*2)
+	for _, k := range keys {
+		kvs = append(kvs, k, nil)
+	}
+	return db.write(lsmDeleted, kvs...)
+}
+
+func (db *lsmDatabase) Get(k []byte) ([]byte, []byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return lsmReader(db.sources()).Get(k)
+}
+
+func (db *lsmDatabase) Seek(startKey []byte, cb func(k, v []byte) int) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return lsmReader(db.sources()).Seek(startKey, cb)
+}
+
+func (db *lsmDatabase) View(fn func(r Reader) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fn(lsmReader(db.sources()))
+}
+
+// lsmReader reads from the sources, caller should hold the lock
+type lsmReader []lsmSource
+
+func (srcs lsmReader) Get(k []byte) ([]byte, []byte, error) {
+	e, ok := lsmFind(srcs, k, SeekPrev, false)
+	if !ok {
+		return nil, nil, nil
+	}
+	v, err := e.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	return append([]byte{}, e.key...), append([]byte{}, v...), nil
+}
+
+func (srcs lsmReader) Seek(startKey []byte, cb func(k, v []byte) int) error {
+	e, ok := lsmFind(srcs, startKey, SeekNext, false)
+	for ok {
+		v, err := e.load()
+		if err != nil {
+			return err
+		}
+
+		switch dir := cb(e.key, v); dir {
+		case SeekPrev, SeekNext:
+			e, ok = lsmFind(srcs, e.key, dir, true)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (db *lsmDatabase) Info() map[string]interface{} {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	size := int64(0)
+	for _, s := range db.segments {
+		size += s.size
+	}
+
+	m := map[string]interface{}{
+		"segment_n":      len(db.segments),
+		"memtable_key_n": db.mem.count,
+		"memtable_size":  db.mem.size,
+		"flush_n":        db.flushN,
+		"compaction_n":   db.compactN,
+		"compacting":     db.compacting,
+		"db_size":        size,
+		"db_size_human":  fmt.Sprintf("%.3fG", float64(size)/1024/1024/1024),
+	}
+	if db.bgErr != nil {
+		m["error"] = db.bgErr.Error()
+	}
+	return m
+}
@@ -0,0 +1,245 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+const lsmSegmentMagic = 0x67736567 // "gseg"
+
+// lsmEntry is a key found in one of the LSM sources (memtable or segment)
+type lsmEntry struct {
+	key     []byte
+	deleted bool
+	value   []byte      // set if the entry comes from a memtable
+	seg     *lsmSegment // set if the entry comes from a segment, value will be read lazily
+	idx     int
+}
+
+func (e lsmEntry) load() ([]byte, error) {
+	if e.seg == nil {
+		return e.value, nil
+	}
+	return e.seg.value(e.idx)
+}
+
+type lsmSource interface {
+	// find finds the smallest key >= key (dir = SeekNext) or the biggest key <= key (dir = SeekPrev),
+	// if strict is true, key itself is excluded
+	find(key []byte, dir int, strict bool) (lsmEntry, bool)
+}
+
+// lsmMemtable stores values prefixed by one byte: lsmValue or lsmDeleted
+type lsmMemtable struct {
+	*memoryDatabase
+}
+
+func (m lsmMemtable) find(key []byte, dir int, strict bool) (lsmEntry, bool) {
+	x := m.findLess(key, nil)
+	if dir == SeekNext {
+		x = x.next[0]
+		if x != nil && strict && bytes.Equal(x.key, key) {
+			x = x.next[0]
+		}
+	} else if nx := x.next[0]; nx != nil && !strict && bytes.Equal(nx.key, key) {
+		x = nx
+	}
+
+	if x == nil || x == m.head {
+		return lsmEntry{}, false
+	}
+	return lsmEntry{key: x.key, deleted: x.value[0] == lsmDeleted, value: x.value[1:]}, true
+}
+
+// lsmSegment is an immutable sorted file:
+// Layout: values... | index | index offset (8b) | count (8b) | index crc32 (4b) | magic (4b)
+// index: [flag (1b)][klen uvarint][key][value offset uvarint][vlen uvarint] ...
+// Keys and value locations are loaded into memory when opened, values are read on demand
+type lsmSegment struct {
+	f       *os.File
+	path    string
+	size    int64
+	keys    [][]byte
+	deleted []bool
+	offs    []int64
+	lens    []int
+}
+
+func writeLSMSegment(path string, iter func(emit func(k []byte, deleted bool, v []byte) error) error) (*lsmSegment, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	index := bytes.Buffer{}
+	off, count := int64(0), int64(0)
+	p := make([]byte, binary.MaxVarintLen64)
+
+	if err := iter(func(k []byte, deleted bool, v []byte) error {
+		if deleted {
+			index.WriteByte(lsmDeleted)
+		} else {
+			index.WriteByte(lsmValue)
+		}
+		index.Write(p[:binary.PutUvarint(p, uint64(len(k)))])
+		index.Write(k)
+		index.Write(p[:binary.PutUvarint(p, uint64(off))])
+		index.Write(p[:binary.PutUvarint(p, uint64(len(v)))])
+		off += int64(len(v))
+		count++
+		_, err := w.Write(v)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	footer := make([]byte, 24)
+	binary.BigEndian.PutUint64(footer, uint64(off))
+	binary.BigEndian.PutUint64(footer[8:], uint64(count))
+	binary.BigEndian.PutUint32(footer[16:], crc32.ChecksumIEEE(index.Bytes()))
+	binary.BigEndian.PutUint32(footer[20:], lsmSegmentMagic)
+	w.Write(index.Bytes())
+	w.Write(footer)
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return openLSMSegment(path)
+}
+
+func openLSMSegment(path string) (*lsmSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := readLSMSegment(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("segment %s: %v", path, err)
+	}
+	s.path = path
+	return s, nil
+}
+
+func readLSMSegment(f *os.File) (*lsmSegment, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < 24 {
+		return nil, fmt.Errorf("corrupted data: too short")
+	}
+
+	footer := make([]byte, 24)
+	if _, err := f.ReadAt(footer, fi.Size()-24); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(footer[20:]) != lsmSegmentMagic {
+		return nil, fmt.Errorf("corrupted data: invalid magic")
+	}
+
+	indexOff, count := int64(binary.BigEndian.Uint64(footer)), int(binary.BigEndian.Uint64(footer[8:]))
+	if indexOff > fi.Size()-24 {
+		return nil, fmt.Errorf("corrupted data: invalid index offset")
+	}
+
+	index := make([]byte, fi.Size()-24-indexOff)
+	if _, err := f.ReadAt(index, indexOff); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(index) != binary.BigEndian.Uint32(footer[16:]) {
+		return nil, fmt.Errorf("corrupted data: index checksum mismatch")
+	}
+
+	s := &lsmSegment{
+		f:       f,
+		size:    fi.Size(),
+		keys:    make([][]byte, 0, count),
+		deleted: make([]bool, 0, count),
+		offs:    make([]int64, 0, count),
+		lens:    make([]int, 0, count),
+	}
+
+	r := bytes.NewReader(index)
+	for i := 0; i < count; i++ {
+		flag, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		kl, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		k := make([]byte, kl)
+		if _, err := io.ReadFull(r, k); err != nil {
+			return nil, err
+		}
+		off, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		vl, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if int64(off+vl) > indexOff {
+			return nil, fmt.Errorf("corrupted data: invalid value offset")
+		}
+		s.keys = append(s.keys, k)
+		s.deleted = append(s.deleted, flag == lsmDeleted)
+		s.offs = append(s.offs, int64(off))
+		s.lens = append(s.lens, int(vl))
+	}
+	return s, nil
+}
+
+func (s *lsmSegment) find(key []byte, dir int, strict bool) (lsmEntry, bool) {
+	i := sort.Search(len(s.keys), func(i int) bool {
+		return bytes.Compare(s.keys[i], key) >= 0
+	})
+
+	if dir == SeekNext {
+		if i < len(s.keys) && strict && bytes.Equal(s.keys[i], key) {
+			i++
+		}
+	} else if i == len(s.keys) || strict || !bytes.Equal(s.keys[i], key) {
+		i--
+	}
+
+	if i < 0 || i >= len(s.keys) {
+		return lsmEntry{}, false
+	}
+	return lsmEntry{key: s.keys[i], deleted: s.deleted[i], seg: s, idx: i}, true
+}
+
+func (s *lsmSegment) value(i int) ([]byte, error) {
+	v := make([]byte, s.lens[i])
+	if _, err := s.f.ReadAt(v, s.offs[i]); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (s *lsmSegment) close() error {
+	return s.f.Close()
+}
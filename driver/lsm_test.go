@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLSMReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := LSMOptions{MemtableSize: 1024, CompactAt: 3}
+	db, err := NewLSM(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2000; i++ {
+		db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprint(i)))
+		if i%3 == 0 {
+			db.Delete([]byte(fmt.Sprintf("key%05d", i/2)))
+		}
+	}
+	db.Close()
+
+	if db.flushN == 0 || db.compactN == 0 {
+		t.Fatal("no flushes or compactions:", db.Info())
+	}
+
+	db, err = NewLSM(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	deleted := map[int]bool{}
+	for i := 0; i < 2000; i += 3 {
+		deleted[i/2] = true
+	}
+
+	count := 0
+	db.Seek(nil, func(k, v []byte) int {
+		var i int
+		fmt.Sscanf(string(k), "key%05d", &i)
+		if deleted[i] || string(v) != fmt.Sprint(i) {
+			t.Fatal(string(k), string(v))
+		}
+		count++
+		return SeekNext
+	})
+	if count != 2000-len(deleted) {
+		t.Fatal(count, db.Info())
+	}
+
+	k, v, _ := db.Get([]byte("key00003"))
+	if string(k) != "key00002" || string(v) != "2" {
+		t.Fatal(string(k), string(v))
+	}
+}
@@ -0,0 +1,96 @@
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// lsmWAL is the write-ahead log of a memtable, every Put/Delete call is stored as one record:
+// Layout: length (4b) | crc32 (4b) | payload
+// payload: [flag (1b)][klen uvarint][vlen uvarint][key][value] ...
+type lsmWAL struct {
+	f    *os.File
+	path string
+	seq  uint64
+	sync bool
+}
+
+func openLSMWAL(path string, seq uint64, sync bool) (*lsmWAL, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &lsmWAL{f: f, path: path, seq: seq, sync: sync}, nil
+}
+
+func encodeLSMRecord(buf *bytes.Buffer, flag byte, k, v []byte) {
+	p := make([]byte, binary.MaxVarintLen64)
+	buf.WriteByte(flag)
+	buf.Write(p[:binary.PutUvarint(p, uint64(len(k)))])
+	buf.Write(p[:binary.PutUvarint(p, uint64(len(v)))])
+	buf.Write(k)
+	buf.Write(v)
+}
+
+func (w *lsmWAL) write(payload []byte) error {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr, uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(payload))
+	if _, err := w.f.Write(append(hdr, payload...)); err != nil {
+		return err
+	}
+	if w.sync {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+func (w *lsmWAL) close() error {
+	return w.f.Close()
+}
+
+// replayLSMWAL applies all intact records to mem, a torn or corrupted tail is ignored
+func replayLSMWAL(path string, mem *memoryDatabase) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(hdr))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:]) {
+			return nil
+		}
+
+		pr := bytes.NewReader(payload)
+		for pr.Len() > 0 {
+			flag, _ := pr.ReadByte()
+			kl, err := binary.ReadUvarint(pr)
+			if err != nil {
+				return err
+			}
+			vl, err := binary.ReadUvarint(pr)
+			if err != nil {
+				return err
+			}
+			kv := make([]byte, kl+vl)
+			if _, err := io.ReadFull(pr, kv); err != nil {
+				return err
+			}
+			mem.put(kv[:kl], append([]byte{flag}, kv[kl:]...))
+		}
+	}
+}
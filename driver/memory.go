@@ -0,0 +1,224 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+const memoryMaxLevel = 24
+
+type memoryNode struct {
+	key   []byte
+	value []byte
+	prev  *memoryNode
+	next  []*memoryNode
+}
+
+// memoryDatabase is an ordered in-memory database backed by a skiplist,
+// nodes are doubly linked at level 0 so cursors can move in both directions
+type memoryDatabase struct {
+	mu    sync.RWMutex
+	head  *memoryNode
+	level int
+	count int
+	size  int64
+	rand  *rand.Rand
+}
+
+func NewMemory() *memoryDatabase {
+	return &memoryDatabase{
+		head:  &memoryNode{next: make([]*memoryNode, memoryMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (db *memoryDatabase) randomLevel() int {
+	l := 1
+	for l < memoryMaxLevel && db.rand.Intn(4) == 0 {
+		l++
+	}
+	return l
+}
+
+// findLess returns the biggest node whose key is less than the requested one (may be head),
+// if update is not nil, predecessors at every level will be stored into it
+func (db *memoryDatabase) findLess(key []byte, update []*memoryNode) *memoryNode {
+	x := db.head
+	for i := db.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x
+}
+
+func (db *memoryDatabase) put(k, v []byte) {
+	update := make([]*memoryNode, memoryMaxLevel)
+	x := db.findLess(k, update)
+
+	if nx := x.next[0]; nx != nil && bytes.Equal(nx.key, k) {
+		db.size += int64(len(v) - len(nx.value))
+		nx.value = append([]byte{}, v...)
+		return
+	}
+
+	l := db.randomLevel()
+	if l > db.level {
+		for i := db.level; i < l; i++ {
+			update[i] = db.head
+		}
+		db.level = l
+	}
+
+	n := &memoryNode{
+		key:   append([]byte{}, k...),
+		value: append([]byte{}, v...),
+		prev:  x,
+		next:  make([]*memoryNode, l),
+	}
+	for i := 0; i < l; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = n
+	}
+
+	db.count++
+	db.size += int64(len(k) + len(v))
+}
+
+func (db *memoryDatabase) delete(k []byte) {
+	update := make([]*memoryNode, memoryMaxLevel)
+	x := db.findLess(k, update).next[0]
+	if x == nil || !bytes.Equal(x.key, k) {
+		return
+	}
+
+	for i := 0; i < len(x.next); i++ {
+		update[i].next[i] = x.next[i]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x.prev
+	}
+	for db.level > 1 && db.head.next[db.level-1] == nil {
+		db.level--
+	}
+
+	db.count--
+	db.size -= int64(len(x.key) + len(x.value))
+}
+
+func (db *memoryDatabase) Close() error {
+	return nil
+}
+
+func (db *memoryDatabase) Put(kvs ...[]byte) error {
+	if len(kvs)%2 != 0 {
+		panic("odd")
+	}
+	if err := checkKeys(kvs); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := 0; i < len(kvs); i += 2 {
+		if len(kvs[i]) == 0 {
+			continue
+		}
+		db.put(kvs[i], kvs[i+1])
+	}
+	return nil
+}
+
+func (db *memoryDatabase) Delete(keys ...[]byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, k := range keys {
+		db.delete(k)
+	}
+	return nil
+}
+
+func (db *memoryDatabase) Get(k []byte) ([]byte, []byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return memoryReader{db}.Get(k)
+}
+
+func (db *memoryDatabase) Seek(startKey []byte, cb func(k, v []byte) int) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return memoryReader{db}.Seek(startKey, cb)
+}
+
+func (db *memoryDatabase) View(fn func(r Reader) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return fn(memoryReader{db})
+}
+
+// memoryReader reads the database without locking, caller should hold the lock
+type memoryReader struct {
+	db *memoryDatabase
+}
+
+func (r memoryReader) Get(k []byte) ([]byte, []byte, error) {
+	db := r.db
+	x := db.findLess(k, nil)
+	if nx := x.next[0]; nx != nil && bytes.Equal(nx.key, k) {
+		x = nx
+	}
+
+	if x == db.head {
+		return nil, nil, nil
+	}
+	return append([]byte{}, x.key...), append([]byte{}, x.value...), nil
+}
+
+func (r memoryReader) Seek(startKey []byte, cb func(k, v []byte) int) error {
+	db := r.db
+	x := db.findLess(startKey, nil).next[0]
+	if x == nil {
+		return nil
+	}
+
+	for todo := cb(x.key, x.value); ; todo = cb(x.key, x.value) {
+		switch todo {
+		case SeekPrev:
+			x = x.prev
+			if x == db.head {
+				x = nil
+			}
+		case SeekNext:
+			x = x.next[0]
+		default:
+			return nil
+		}
+
+		if x == nil {
+			return nil
+		}
+	}
+}
+
+func (db *memoryDatabase) Info() map[string]interface{} {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return map[string]interface{}{
+		"key_n":         db.count,
+		"level":         db.level,
+		"db_size":       db.size,
+		"db_size_human": fmt.Sprintf("%.3fG", float64(db.size)/1024/1024/1024),
+	}
+}
@@ -0,0 +1,47 @@
+package driver
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	db := NewMemory()
+	for i := 0; i < 1000; i += 2 {
+		db.Put([]byte("key"+strconv.Itoa(10000+i)), []byte(strconv.Itoa(i)))
+	}
+
+	k, v, _ := db.Get([]byte("key10003"))
+	if string(k) != "key10002" || string(v) != "2" {
+		t.Fatal(string(k), string(v))
+	}
+	if k, _, _ := db.Get([]byte("a")); k != nil {
+		t.Fatal(string(k))
+	}
+	if k, _, _ := db.Get([]byte("z")); string(k) != "key10998" {
+		t.Fatal(string(k))
+	}
+
+	keys := []string{}
+	db.Seek([]byte("key10501"), func(k, v []byte) int {
+		keys = append(keys, string(k))
+		if len(keys) < 3 {
+			return SeekNext
+		}
+		if len(keys) < 6 {
+			return SeekPrev
+		}
+		return SeekAbort
+	})
+	if len(keys) != 6 || keys[0] != "key10502" || keys[2] != "key10506" || keys[5] != "key10500" {
+		t.Fatal(keys)
+	}
+
+	db.Delete([]byte("key10002"))
+	if k, _, _ := db.Get([]byte("key10003")); string(k) != "key10000" {
+		t.Fatal(string(k))
+	}
+	if db.count != 499 {
+		t.Fatal(db.count)
+	}
+}
@@ -1,8 +1,86 @@
 package driver
 
+import "fmt"
+
 const (
 	SeekPrev  = -1
 	SeekNext  = 1
 	SeekAbort = 2
 )
 
+// MaxKeySize is the maximum key size accepted by the memory and LSM drivers, the same as bbolt
+const MaxKeySize = 32768
+
+var ErrKeyTooLarge = fmt.Errorf("key too large")
+
+// checkKeys checks keys of the key-value pairs before any of them is written
+func checkKeys(kvs [][]byte) error {
+	for i := 0; i < len(kvs); i += 2 {
+		if len(kvs[i]) > MaxKeySize {
+			return ErrKeyTooLarge
+		}
+	}
+	return nil
+}
+
+// Reader reads an ordered key-value store, see KeyValueDatabase for the semantics
+type Reader interface {
+	Get(key []byte) ([]byte, []byte, error)
+	Seek(startKey []byte, cb func(k, v []byte) int) error
+}
+
+// BaseDatabase is an ordered key-value store, keys are compared bytewise.
+// It is the contract of drivers written before View was introduced, see WithView
+type BaseDatabase interface {
+	// Get finds the requested key and its value, if not found, the biggest key before
+	// the requested key will and should be returned
+	// If no keys can be returned, callee should return (nil, nil, nil)
+	// Returned slices are owned by the caller and may be modified
+	Get(key []byte) ([]byte, []byte, error)
+
+	// Put puts the key-value pairs into the database,
+	// All key-value pairs should all be stored successfully or not
+	// Pairs with empty keys are ignored, callee may not retain the passed slices
+	Put(keyvalues ...[]byte) error
+
+	// Delete deletes keys from the database
+	Delete(keys ...[]byte) error
+
+	// Seek seeks the requested key and use the callback function to determine
+	// whether it should go forward (next key), backward (prev key) or quit
+	// The cursor starts at the first key >= startKey, if there is none, cb will not be called
+	// All keys visited in one Seek should come from the same consistent view of the database,
+	// k and v are only valid inside cb
+	Seek(startKey []byte, cb func(k, v []byte) int) error
+
+	// Close closes the database
+	Close() error
+
+	Info() map[string]interface{}
+}
+
+// KeyValueDatabase is an ordered key-value store supporting consistent views
+type KeyValueDatabase interface {
+	BaseDatabase
+
+	// View calls fn with a read-only view of the database, all reads through r
+	// observe the same consistent state, r is only valid inside fn
+	View(fn func(r Reader) error) error
+}
+
+// WithView returns db itself if it implements View, otherwise a wrapper whose View
+// reads db directly, so reads in one View may observe different states
+func WithView(db BaseDatabase) KeyValueDatabase {
+	if kv, ok := db.(KeyValueDatabase); ok {
+		return kv
+	}
+	return unviewedDatabase{db}
+}
+
+type unviewedDatabase struct {
+	BaseDatabase
+}
+
+func (db unviewedDatabase) View(fn func(r Reader) error) error {
+	return fn(db.BaseDatabase)
+}
@@ -1,6 +1,8 @@
-package main
+package gouch
 
 import (
+	"io/ioutil"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -19,17 +21,55 @@ func TestDriver(t *testing.T) {
 	// t.Log(x.Seek([]byte("hello3"), 1))
 }
 
+func testNode(t *testing.T, opts Options) *Node {
+	dir, err := ioutil.TempDir("", "gouch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.DataDir = dir
+	if opts.Name == "" {
+		opts.Name = "test"
+	}
+	n, err := NewNode(opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return n
+}
+
+func closeTestNode(n *Node) {
+	n.Close()
+	os.RemoveAll(n.path)
+}
+
 func TestNode(t *testing.T) {
-	n, _ := NewNode("test", "bbolt", "testlog")
+	for _, d := range []string{"bbolt", "memory"} {
+		testNodeDriver(t, d)
+	}
+}
+
+func testNodeDriver(t *testing.T, driverName string) {
+	n := testNode(t, Options{Driver: driverName})
+	defer closeTestNode(n)
+
 	t.Log(n.Get("aaa"))
-	n.Put("aaa", []byte{})
+	n.Put("aaa", []byte{}, false)
 	t.Log(n.Get("aaa"))
-	n.Put("aaa", []byte("haha"))
-	n.Put("aaa1", []byte("one"+strconv.Itoa(int(time.Now().Unix()))))
+	n.Put("aaa", []byte("haha"), false)
+	n.Put("aaa1", []byte("one"+strconv.Itoa(int(time.Now().Unix()))), false)
 	t.Log(n.Get("aaa"))
 	t.Log(n.Get("aaa1"))
 
+	if e, err := n.Get("aaa"); err != nil || e.Value != "haha" {
+		t.Fatal(e, err)
+	}
+
 	// t.Log(n.GetChangedKeysSince(0, 100))
-	res, _ := n.GetAllVersions("aaa1", 0)
-	t.Log(proto.Marshal(res))
+	res, _, _ := n.GetAllVersions("aaa", 0, 100, false)
+	if len(res) != 2 {
+		t.Fatal(res)
+	}
+	p, _ := n.GetChangedKeysSince(0, 100)
+	t.Log(proto.Marshal(p))
 }
@@ -4,9 +4,16 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coyove/gouch/clock"
 )
@@ -14,13 +21,83 @@ import (
 const (
 	blockSize    = 24
 	blockKeySize = blockSize - 8
+
+	// linkedFlag is stored in the length byte of the block head, it indicates that
+	// the record is followed by another record written in the same Append
+	linkedFlag = 0x80
+
+	// checksumFlag marks the block following blocks of a record, it holds the CRC32 of them.
+	// Records written before checksums were introduced have no such blocks
+	checksumFlag = 0x40
+
+	// inlineChecksumFlag marks the last block of a record whose key leaves room for the CRC32,
+	// it is stored in the last 4 bytes (taken as zeros when computing it) and no checksum block follows
+	inlineChecksumFlag = 0x20
+	inlineKeySize      = blockKeySize - 4
+
+	flagMask = linkedFlag | checksumFlag | inlineChecksumFlag
+)
+
+const (
+	SyncNever    = "never"    // leave it to the OS (default)
+	SyncAlways   = "always"   // fsync before Append commits
+	SyncInterval = "interval" // fsync every SyncInterval in background
 )
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options of the log
+type Options struct {
+	// SegmentSize is the size in bytes at which the log will be rotated into a new segment file, default 64M.
+	// Records written in one Append are never split, so a segment may exceed it by one Append
+	SegmentSize int64
+
+	// ArchiveDir, if provided, is where dropped segments will be moved to (on the same filesystem),
+	// otherwise they will be deleted
+	ArchiveDir string
+
+	// Sync is the fsync policy, SyncNever, SyncAlways or SyncInterval. Records not synced may be lost
+	// on crashes, while their commits (e.g. in the database) may have been persisted
+	Sync string
+
+	// SyncInterval is the interval of fsync for SyncInterval, default 1s
+	SyncInterval time.Duration
+}
+
+// The log is split into segment files named 'path.<seq>', the last one is active and written.
+// Segments are indexed by the timestamps of their first records, so a cursor only searches one segment
+type segment struct {
+	seq   uint64
+	path  string
+	start int64 // timestamp of the first record, 0 if empty
+	size  int64 // size of sealed segments, the active one uses Handler.end
+}
+
+// SegmentInfo describes one segment of the log
+type SegmentInfo struct {
+	Path  string `json:"path"`
+	Start int64  `json:"start"`
+	Size  int64  `json:"size"`
+}
+
 type Handler struct {
 	sync.Mutex
-	f       *os.File
+	f       *os.File // the active segment
 	path    string
-	genesis int64
+	opts    Options
+	end     int64 // end of committed records in the active segment, cursors will not go beyond it
+	changed chan struct{}
+	dirty   bool // written but not synced
+	stop    chan struct{}
+
+	discarded     int
+	discardedSize int64
+
+	pending []*pending // written but not committed, in the order of timestamps
+
+	segMu    sync.RWMutex
+	segments []*segment // oldest first
+	sealed   int64      // total size of sealed segments
 }
 
 func getHeadLastTimestamp(f *os.File) (int64, int64, error) {
@@ -38,142 +115,625 @@ func getHeadLastTimestamp(f *os.File) (int64, int64, error) {
 	}
 
 	c := Cursor{fd: f}
-	last, _, err := c.readBlock(end - blockSize)
+	last, err := c.readBlock(end - blockSize)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	head, _, err := c.readBlock(0)
+	head, err := c.readBlock(0)
 	if err != nil {
 		return 0, 0, err
 	}
-	return head, last, nil
+	return blockTs(head), blockTs(last), nil
 }
 
-func Open(path string) (*Handler, error) {
-	ts := clock.Timestamp()
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0777)
+func segmentPath(path string, seq uint64) string {
+	return fmt.Sprintf("%s.%016x", path, seq)
+}
+
+// listSegments returns sequences of all segments of the log, in ascending order
+func listSegments(path string) ([]uint64, error) {
+	names, err := filepath.Glob(path + ".*")
 	if err != nil {
 		return nil, err
 	}
+	seqs := []uint64{}
+	for _, name := range names {
+		suffix := strings.TrimPrefix(name, path+".")
+		if len(suffix) != 16 {
+			continue
+		}
+		if seq, err := strconv.ParseUint(suffix, 16, 64); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func Open(path string, opts Options) (*Handler, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 64 << 20
+	}
+	if opts.SegmentSize = opts.SegmentSize / blockSize * blockSize; opts.SegmentSize == 0 {
+		opts.SegmentSize = blockSize
+	}
+	switch opts.Sync {
+	case "":
+		opts.Sync = SyncNever
+	case SyncNever, SyncAlways, SyncInterval:
+	default:
+		return nil, fmt.Errorf("filelog: unknown sync policy: %q", opts.Sync)
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
 
-	head, lastts, err := getHeadLastTimestamp(f)
+	ts := clock.Timestamp()
+	seqs, err := listSegments(path)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := f.Seek(0, 2); err != nil {
-		return nil, err
+	// Logs written before segmentation are a single file at path, which becomes the first segment
+	if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+		if len(seqs) > 0 {
+			return nil, fmt.Errorf("filelog: both %q and its segments exist", path)
+		}
+		if err := os.Rename(path, segmentPath(path, 0)); err != nil {
+			return nil, err
+		}
+		seqs = []uint64{0}
+	}
+	if len(seqs) == 0 {
+		seqs = []uint64{0}
+	}
+
+	handle := &Handler{
+		path:    path,
+		opts:    opts,
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+
+	lastts := int64(0)
+	for i, seq := range seqs {
+		s := &segment{seq: seq, path: segmentPath(path, seq)}
+		f, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR, 0777)
+		if err != nil {
+			return nil, err
+		}
+
+		// The active segment may have a torn tail if the process died while writing,
+		// sealed segments should be intact unless they are not aligned
+		fi, err := f.Stat()
+		if err == nil && (i == len(seqs)-1 || fi.Size()%blockSize != 0) {
+			var records int
+			var size int64
+			records, size, err = recoverSegment(f)
+			handle.discarded += records
+			handle.discardedSize += size
+		}
+
+		var head, last int64
+		if err == nil {
+			head, last, err = getHeadLastTimestamp(f)
+		}
+		if err == nil {
+			s.size, err = f.Seek(0, 2)
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("segment %s: %v", s.path, err)
+		}
+		s.start = head
+		if last > 0 {
+			lastts = last
+		}
+
+		handle.segments = append(handle.segments, s)
+		if i < len(seqs)-1 {
+			handle.sealed += s.size
+			f.Close()
+		} else {
+			handle.f, handle.end = f, s.size
+		}
 	}
 
 	if ts < lastts {
+		handle.f.Close()
 		return nil, fmt.Errorf("filelog time skew: last: %v, now: %v", lastts, ts)
 	}
 
-	return &Handler{
-		f:       f,
-		path:    path,
-		genesis: head,
-	}, nil
+	if opts.Sync == SyncInterval {
+		go handle.syncWorker()
+	}
+	return handle, nil
+}
+
+func (handle *Handler) syncWorker() {
+	for {
+		select {
+		case <-handle.stop:
+			return
+		case <-time.After(handle.opts.SyncInterval):
+		}
+
+		handle.Lock()
+		if handle.dirty && handle.f.Sync() == nil {
+			handle.dirty = false
+		}
+		handle.Unlock()
+	}
 }
 
 func (handle *Handler) Close() error {
+	close(handle.stop)
+
+	handle.Lock()
+	defer handle.Unlock()
+	if handle.opts.Sync != SyncNever && handle.dirty {
+		handle.f.Sync()
+	}
 	return handle.f.Close()
 }
 
+// Recovered returns the number of torn records and bytes discarded from the tail of the log when opening it
+func (handle *Handler) Recovered() (int, int64) {
+	return handle.discarded, handle.discardedSize
+}
+
+// Genesis returns the timestamp of the oldest record in the log
 func (handle *Handler) Genesis() int64 {
-	return handle.genesis
+	handle.segMu.RLock()
+	defer handle.segMu.RUnlock()
+	return handle.segments[0].start
+}
+
+// Segments returns all segments of the log, oldest first
+func (handle *Handler) Segments() []SegmentInfo {
+	handle.segMu.RLock()
+	defer handle.segMu.RUnlock()
+	res := make([]SegmentInfo, len(handle.segments))
+	for i, s := range handle.segments {
+		res[i] = SegmentInfo{Path: s.path, Start: s.start, Size: s.size}
+	}
+	res[len(res)-1].Size = atomic.LoadInt64(&handle.end)
+	return res
 }
 
+// Truncated returns the timestamp before which records have been dropped by DropSegments, 0 if none
+func (handle *Handler) Truncated() int64 {
+	handle.segMu.RLock()
+	defer handle.segMu.RUnlock()
+	if s := handle.segments[0]; s.seq > 0 {
+		return s.start
+	}
+	return 0
+}
+
+// DropSegments drops sealed segments whose records are all before the timestamp,
+// they will be moved into Options.ArchiveDir if provided, otherwise deleted.
+// It returns the number of segments dropped
+func (handle *Handler) DropSegments(before int64) (int, error) {
+	handle.segMu.Lock()
+	defer handle.segMu.Unlock()
+
+	if handle.opts.ArchiveDir != "" {
+		if err := os.MkdirAll(handle.opts.ArchiveDir, 0777); err != nil {
+			return 0, err
+		}
+	}
+
+	dropped := 0
+	for len(handle.segments) > 1 {
+		// The next segment starts after all records of this one
+		s, next := handle.segments[0], handle.segments[1]
+		if next.start == 0 || next.start > before {
+			break
+		}
+
+		var err error
+		if handle.opts.ArchiveDir != "" {
+			err = os.Rename(s.path, filepath.Join(handle.opts.ArchiveDir, filepath.Base(s.path)))
+		} else {
+			err = os.Remove(s.path)
+		}
+		if err != nil {
+			return dropped, err
+		}
+
+		handle.segments = handle.segments[1:]
+		handle.sealed -= s.size
+		dropped++
+	}
+	return dropped, nil
+}
+
+// Changed returns a channel which will be closed when new records are committed
+func (handle *Handler) Changed() <-chan struct{} {
+	handle.Lock()
+	defer handle.Unlock()
+	return handle.changed
+}
+
+// Size returns the total size of all segments
 func (handle *Handler) Size() int64 {
-	end, _ := handle.f.Seek(0, 2)
-	return end
+	handle.segMu.RLock()
+	defer handle.segMu.RUnlock()
+	return handle.sealed + atomic.LoadInt64(&handle.end)
+}
+
+// Barrier returns a timestamp, all records before it have been committed,
+// and records appended later will have bigger timestamps
+func (handle *Handler) Barrier() int64 {
+	handle.Lock()
+	ts := clock.Timestamp()
+	var last *pending
+	if len(handle.pending) > 0 {
+		last = handle.pending[len(handle.pending)-1]
+	}
+	handle.Unlock()
+
+	// Pending records are published in order, waiting for the last one is enough
+	if last != nil {
+		<-last.settled
+	}
+	return ts
 }
 
 func (handle *Handler) GetTimestampForKey(key []byte) (int64, error) {
-	if len(key) == 0 {
-		return 0, fmt.Errorf("null key not allowed")
+	ts, err := handle.Append([][]byte{key}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return ts[0], nil
+}
+
+// pending is a group of records written but not yet visible to cursors
+type pending struct {
+	start, end int64
+	ts         int64 // timestamp of the first record
+	done       bool
+	settled    chan struct{}
+}
+
+// Append allocates one timestamp for each key and writes them into the log in one write.
+// If commit is not nil, it will be called with the allocated timestamps while the log is still locked,
+// so commits are serialized in the order of timestamps. If commit fails, written records will be rolled back
+func (handle *Handler) Append(keys [][]byte, commit func(ts []int64) error) ([]int64, error) {
+	handle.Lock()
+	defer handle.Unlock()
+
+	tss, p, err := handle.reserve(keys)
+	if err != nil {
+		return nil, err
+	}
+	if commit != nil {
+		if err := commit(tss); err != nil {
+			handle.cancel(p)
+			return nil, err
+		}
+	}
+	p.done = true
+	handle.settle()
+	return tss, nil
+}
+
+// Write is like Append, but commit is called without holding the log, so commits of different
+// writes may run concurrently and callers should serialize conflicting ones by themselves.
+// Records become visible to cursors in the order of timestamps once all earlier commits finish.
+// If commit fails, written records will be rolled back if they are the last ones in the log,
+// otherwise they are kept, as if they were committed with no changes
+func (handle *Handler) Write(keys [][]byte, commit func(ts []int64) error) ([]int64, error) {
+	handle.Lock()
+	tss, p, err := handle.reserve(keys)
+	handle.Unlock()
+	if err != nil {
+		return nil, err
 	}
 
+	err = commit(tss)
+
 	handle.Lock()
 	defer handle.Unlock()
+	if err != nil {
+		handle.cancel(p)
+		return nil, err
+	}
+	p.done = true
+	handle.settle()
+	return tss, nil
+}
 
-	ts := clock.Timestamp()
+// reserve writes records of keys into the log and adds them to the pending list,
+// caller should hold the lock
+func (handle *Handler) reserve(keys [][]byte) ([]int64, *pending, error) {
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, nil, fmt.Errorf("null key not allowed")
+		}
+	}
 
 	p := make([]byte, blockSize)
 	buf := bytes.Buffer{}
+	tss := make([]int64, len(keys))
+
+	for idx, key := range keys {
+		ts := clock.Timestamp()
+		tss[idx] = ts
 
-	for i := 0; i < len(key); i += blockKeySize {
-		end := i + blockKeySize
-		if end > len(key) {
-			end = len(key)
+		flag := uint64(0)
+		if idx < len(keys)-1 {
+			flag = linkedFlag
 		}
 
-		ln := uint64(len(key[i:end]))
+		start := buf.Len()
+		for i := 0; i < len(key); i += blockKeySize {
+			end := i + blockKeySize
+			if end > len(key) {
+				end = len(key)
+			}
+
+			ln := uint64(len(key[i:end]))
+			if end == len(key) && ln <= inlineKeySize {
+				ln |= inlineChecksumFlag
+			}
+
+			binary.BigEndian.PutUint64(p, uint64(ts)|((ln|flag)<<56))
+			copy(p[8:], key[i:end])
+			for j := 8 + len(key[i:end]); j < blockSize; j++ {
+				p[j] = 0
+			}
 
-		binary.BigEndian.PutUint64(p, uint64(ts)|(ln<<56))
-		copy(p[8:], key[i:end])
+			buf.Write(p)
+		}
 
+		// The checksum covers all blocks of the key, inline if possible
+		crc := crc32.Checksum(buf.Bytes()[start:], crcTable)
+		if last := buf.Bytes()[buf.Len()-blockSize:]; blockFlag(last)&inlineChecksumFlag != 0 {
+			binary.BigEndian.PutUint32(last[blockSize-4:], crc)
+			continue
+		}
+		binary.BigEndian.PutUint64(p, uint64(ts)|(uint64(4|checksumFlag)<<56))
+		binary.BigEndian.PutUint32(p[8:], crc)
+		for j := 12; j < blockSize; j++ {
+			p[j] = 0
+		}
 		buf.Write(p)
 	}
 
+	// Segments can't be rotated with pending records, which may make it exceed SegmentSize a little
+	if end := handle.end; len(handle.pending) == 0 && end > 0 && end+int64(buf.Len()) > handle.opts.SegmentSize {
+		if err := handle.rotate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	off, err := handle.f.Seek(0, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	if _, err := handle.f.Write(buf.Bytes()); err != nil {
-		return 0, err
+		handle.rollback(off)
+		return nil, nil, err
+	}
+
+	if handle.opts.Sync == SyncAlways {
+		if err := handle.f.Sync(); err != nil {
+			handle.rollback(off)
+			return nil, nil, err
+		}
+	} else {
+		handle.dirty = true
 	}
 
-	return ts, nil
+	pd := &pending{start: off, end: off + int64(buf.Len()), ts: tss[0], settled: make(chan struct{})}
+	handle.pending = append(handle.pending, pd)
+	return tss, pd, nil
+}
+
+// cancel rolls back records of the failed commit, caller should hold the lock
+func (handle *Handler) cancel(p *pending) {
+	if last := len(handle.pending) - 1; handle.pending[last] == p {
+		handle.pending = handle.pending[:last]
+		handle.rollback(p.start)
+		close(p.settled)
+		handle.settle()
+		return
+	}
+	p.done = true
+	handle.settle()
+}
+
+// settle publishes committed records in order, caller should hold the lock
+func (handle *Handler) settle() {
+	published := false
+	for len(handle.pending) > 0 && handle.pending[0].done {
+		p := handle.pending[0]
+		handle.pending = handle.pending[1:]
+		if p.start == 0 {
+			handle.segMu.Lock()
+			handle.segments[len(handle.segments)-1].start = p.ts
+			handle.segMu.Unlock()
+		}
+		atomic.StoreInt64(&handle.end, p.end)
+		close(p.settled)
+		published = true
+	}
+	if published {
+		close(handle.changed)
+		handle.changed = make(chan struct{})
+	}
+}
+
+// rotate seals the active segment and starts a new one, caller should hold the lock
+func (handle *Handler) rotate() error {
+	if handle.opts.Sync != SyncNever && handle.dirty {
+		if err := handle.f.Sync(); err != nil {
+			return err
+		}
+		handle.dirty = false
+	}
+
+	last := handle.segments[len(handle.segments)-1]
+	s := &segment{seq: last.seq + 1, path: segmentPath(handle.path, last.seq+1)}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0777)
+	if err != nil {
+		return err
+	}
+
+	handle.segMu.Lock()
+	last.size = handle.end
+	handle.sealed += last.size
+	handle.segments = append(handle.segments, s)
+	atomic.StoreInt64(&handle.end, 0)
+	handle.segMu.Unlock()
+
+	handle.f.Close()
+	handle.f = f
+	return nil
+}
+
+func (handle *Handler) rollback(off int64) {
+	if err := handle.f.Truncate(off); err == nil {
+		handle.f.Seek(off, 0)
+	}
 }
 
 type Cursor struct {
 	fd     *os.File
 	offset int64
 	end    int64
+	linked bool
+	segs   []segment // segments after the current one
 }
 
 func (c *Cursor) Next() bool {
 	c.offset += blockSize
+	c.nextSegment()
 	return c.offset < c.end
 }
 
+// nextSegment moves the cursor to the next non-empty segment if the current one is exhausted,
+// if the next segment can't be opened, the cursor ends there
+func (c *Cursor) nextSegment() {
+	for c.offset >= c.end && len(c.segs) > 0 {
+		s := c.segs[0]
+		if s.size == 0 {
+			c.segs = c.segs[1:]
+			continue
+		}
+		f, err := os.Open(s.path)
+		if err != nil {
+			c.segs = nil
+			return
+		}
+		c.fd.Close()
+		c.fd, c.offset, c.end, c.segs = f, 0, s.size, c.segs[1:]
+	}
+}
+
 func (c *Cursor) End() bool {
 	return c.offset >= c.end
 }
 
+// Linked returns whether the record returned by the last Data call
+// is followed by another record written in the same Append
+func (c *Cursor) Linked() bool {
+	return c.linked
+}
+
+// Data returns the record at the cursor, its checksum (if any) will be verified
 func (c *Cursor) Data() (int64, []byte, error) {
-	ts, key, err := c.readBlock(c.offset)
-	if err == nil {
-		for off := c.offset + blockSize; c.offset < c.end; off += blockSize {
-			ts2, key2, err := c.readBlock(off)
-			if err != nil {
-				break
+	b, err := c.readBlock(c.offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	ts, key := blockTs(b), blockKey(b)
+	c.linked = blockFlag(b)&linkedFlag != 0
+	crc := blockChecksum(0, b)
+	if blockFlag(b)&inlineChecksumFlag != 0 {
+		if inlineChecksum(b) != crc {
+			return ts, key, fmt.Errorf("checksum mismatch at %v", c.offset)
+		}
+		return ts, key, nil
+	}
+
+	for off := c.offset + blockSize; off < c.end; off += blockSize {
+		b, err := c.readBlock(off)
+		if err != nil || blockTs(b) != ts {
+			break
+		}
+		c.offset = off
+		if blockFlag(b)&checksumFlag != 0 {
+			if binary.BigEndian.Uint32(b[8:]) != crc {
+				return ts, key, fmt.Errorf("checksum mismatch at %v", off)
 			}
-			if ts2 != ts {
-				break
+			break
+		}
+		key = append(key, blockKey(b)...)
+		crc = blockChecksum(crc, b)
+		if blockFlag(b)&inlineChecksumFlag != 0 {
+			if inlineChecksum(b) != crc {
+				return ts, key, fmt.Errorf("checksum mismatch at %v", off)
 			}
-			key = append(key, key2...)
-			c.offset += blockSize
+			break
 		}
 	}
-	return ts, key, err
+	return ts, key, nil
 }
 
-func (c *Cursor) readBlock(offset int64) (int64, []byte, error) {
+func blockTs(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) << 8 >> 8)
+}
+
+func blockFlag(b []byte) byte {
+	return b[0] & flagMask
+}
+
+func blockKey(b []byte) []byte {
+	return b[8 : 8+b[0]&^flagMask]
+}
+
+// blockChecksum updates crc with the block, whose inline checksum is taken as zeros
+func blockChecksum(crc uint32, b []byte) uint32 {
+	if blockFlag(b)&inlineChecksumFlag == 0 {
+		return crc32.Update(crc, crcTable, b)
+	}
+	crc = crc32.Update(crc, crcTable, b[:blockSize-4])
+	return crc32.Update(crc, crcTable, make([]byte, 4))
+}
+
+func inlineChecksum(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b[blockSize-4:])
+}
+
+func validBlock(b []byte) error {
+	ln := b[0] &^ flagMask
+	if ln > blockKeySize {
+		return fmt.Errorf("invalid head length: %v", ln)
+	}
+	if b[0]&inlineChecksumFlag != 0 && ln > inlineKeySize {
+		return fmt.Errorf("invalid head length: %v", ln)
+	}
+	return nil
+}
+
+func (c *Cursor) readBlock(offset int64) ([]byte, error) {
 	if _, err := c.fd.Seek(offset, 0); err != nil {
-		return 0, nil, err
+		return nil, err
 	}
 
 	buf := make([]byte, blockSize)
 	if _, err := io.ReadFull(c.fd, buf); err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-
-	head := binary.BigEndian.Uint64(buf)
-	ts := int64(head << 8 >> 8)
-	ln := byte(head >> 56)
-	if ln > blockKeySize {
-		return 0, nil, fmt.Errorf("invalid head length: %v", ln)
+	if err := validBlock(buf); err != nil {
+		return nil, err
 	}
-	return ts, buf[8 : 8+ln], nil
+	return buf, nil
 }
 
 func (c *Cursor) Close() error {
@@ -181,54 +741,68 @@ func (c *Cursor) Close() error {
 }
 
 func (c *Cursor) findNeig() {
-	ts, _, err := c.readBlock(c.offset)
+	b, err := c.readBlock(c.offset)
 	if err != nil {
 		return
 	}
 
 	for c.offset > 0 {
-		ts2, _, err := c.readBlock(c.offset - blockSize)
+		b2, err := c.readBlock(c.offset - blockSize)
 		if err != nil {
 			return
 		}
-		if ts != ts2 {
+		if blockTs(b) != blockTs(b2) {
 			break
 		}
 		c.offset -= blockSize
 	}
 }
 
+// GetCursor returns the cursor pointing to the first record at or after startTimestamp
 func (handle *Handler) GetCursor(startTimestamp int64) (*Cursor, error) {
-	fi, err := os.Stat(handle.path)
-	if err != nil {
-		return nil, err
+	handle.segMu.RLock()
+	segs := make([]segment, len(handle.segments))
+	for i, s := range handle.segments {
+		segs[i] = *s
+	}
+	segs[len(segs)-1].size = atomic.LoadInt64(&handle.end)
+	handle.segMu.RUnlock()
+
+	// Find the last segment starting at or before startTimestamp, only the active one can be empty
+	i := sort.Search(len(segs), func(i int) bool {
+		return segs[i].size == 0 || segs[i].start > startTimestamp
+	})
+	if i > 0 {
+		i--
 	}
 
-	end := fi.Size()
+	end := segs[i].size
 	if end/blockSize*blockSize != end {
 		return nil, fmt.Errorf("corrupted data, not %v bytes aligned", blockSize)
 	}
 
-	f, err := os.Open(handle.path)
+	f, err := os.Open(segs[i].path)
 	if err != nil {
 		return nil, err
 	}
 
 	start := int64(0)
 	c := &Cursor{
-		fd:  f,
-		end: end,
+		fd:   f,
+		end:  end,
+		segs: segs[i+1:],
 	}
 
 	for start <= end-blockSize {
 		h := (start + end) / 2
 		h = h / blockSize * blockSize
 
-		ts, _, err := c.readBlock(h)
+		b, err := c.readBlock(h)
 		if err != nil {
 			f.Close()
 			return nil, err
 		}
+		ts := blockTs(b)
 
 		// log.Println(ts, startTimestamp, string(bytes.Trim(buf[8:], "\x00")), start, h, end)
 		if startTimestamp == ts {
@@ -246,5 +820,6 @@ func (handle *Handler) GetCursor(startTimestamp int64) (*Cursor, error) {
 
 	c.offset = start
 	// c.findNeig()
+	c.nextSegment()
 	return c, nil
 }
@@ -1,7 +1,12 @@
 package filelog
 
 import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -10,9 +15,40 @@ import (
 	"github.com/coyove/gouch/clock"
 )
 
+func testLog(t testing.TB, opts Options) (*Handler, string) {
+	dir, err := ioutil.TempDir("", "filelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := Open(filepath.Join(dir, "testlog"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, dir
+}
+
+// readAll returns keys of all records in the log
+func readAll(h *Handler) (res []string, err error) {
+	c, err := h.GetCursor(0)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	for !c.End() {
+		_, key, err := c.Data()
+		if err != nil {
+			return res, err
+		}
+		res = append(res, string(key))
+		c.Next()
+	}
+	return res, nil
+}
+
 func TestOpen(t *testing.T) {
-	// os.Remove("testlog")
-	h, _ := Open("testlog")
+	h, dir := testLog(t, Options{SegmentSize: 1 << 20})
+	defer os.RemoveAll(dir)
+	defer h.Close()
 
 	now := time.Now()
 	rand.Seed(now.Unix())
@@ -60,9 +96,271 @@ func TestOpen(t *testing.T) {
 	}
 }
 
+func TestSegments(t *testing.T) {
+	h, dir := testLog(t, Options{SegmentSize: blockSize * 10})
+	defer os.RemoveAll(dir)
+
+	// Every record takes one block, the checksum fits in it
+	tss, keys := []int64{}, []string{}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, "key"+strconv.Itoa(i))
+		ts, err := h.GetTimestampForKey([]byte(keys[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tss = append(tss, ts)
+	}
+	if n := len(h.Segments()); n != 10 {
+		t.Fatal("segments:", n)
+	}
+	if h.Size() != 100*blockSize || h.Genesis() != tss[0] {
+		t.Fatal(h.Size(), h.Genesis())
+	}
+
+	check := func(h *Handler, from int) {
+		c, err := h.GetCursor(tss[from])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for i := from; i < len(tss); i++ {
+			ts, key, err := c.Data()
+			if err != nil || ts != tss[i] || string(key) != keys[i] {
+				t.Fatal(i, ts, string(key), err)
+			}
+			if c.Next() != (i < len(tss)-1) {
+				t.Fatal("cursor not ended at", i)
+			}
+		}
+	}
+	for _, from := range []int{0, 9, 10, 11, 55, 99} {
+		check(h, from)
+	}
+
+	// Records of one Append are never split
+	abc, _ := h.Append([][]byte{[]byte("a"), []byte("b"), []byte("c")}, nil)
+	tss, keys = append(tss, abc...), append(keys, "a", "b", "c")
+	if segs := h.Segments(); segs[len(segs)-1].Size != 3*blockSize {
+		t.Fatal(segs)
+	}
+	if c, _ := h.GetCursor(tss[99] + 1); c.End() {
+		t.Fatal("cursor should move to the next segment")
+	} else {
+		c.Close()
+	}
+	check(h, 99)
+
+	// Reopen and drop
+	h.Close()
+	h, err := Open(filepath.Join(dir, "testlog"), Options{SegmentSize: blockSize * 10, ArchiveDir: filepath.Join(dir, "archive")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if n := len(h.Segments()); n != 11 {
+		t.Fatal("segments:", n)
+	}
+	check(h, 25)
+
+	if n, err := h.DropSegments(tss[25]); n != 2 || err != nil {
+		t.Fatal(n, err)
+	}
+	if h.Genesis() != tss[20] || h.Size() != 83*blockSize {
+		t.Fatal(h.Genesis(), h.Size())
+	}
+	if archived, _ := filepath.Glob(filepath.Join(dir, "archive", "testlog.*")); len(archived) != 2 {
+		t.Fatal(archived)
+	}
+	check(h, 20)
+	if c, _ := h.GetCursor(0); c.End() {
+		t.Fatal("cursor ended")
+	} else if ts, _, _ := c.Data(); ts != tss[20] {
+		t.Fatal(ts)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	h, dir := testLog(t, Options{})
+	defer os.RemoveAll(dir)
+	defer h.Close()
+
+	started, release := make(chan int64), make(chan struct{})
+	errc := make(chan error)
+	go func() {
+		_, err := h.Write([][]byte{[]byte("a")}, func(ts []int64) error {
+			started <- ts[0]
+			<-release
+			return nil
+		})
+		errc <- err
+	}()
+	a := <-started
+
+	// Later writes are committed but not visible until the earlier one finishes
+	b, err := h.Write([][]byte{[]byte("b")}, func([]int64) error { return nil })
+	if err != nil || b[0] <= a {
+		t.Fatal(b, err)
+	}
+	if _, err := h.Write([][]byte{[]byte("c")}, func([]int64) error { return fmt.Errorf("failed") }); err == nil {
+		t.Fatal("commit error not returned")
+	}
+	if h.Size() != 0 {
+		t.Fatal("published before commit:", h.Size())
+	}
+
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if res, err := readAll(h); err != nil || strings.Join(res, ",") != "a,b" || h.Genesis() != a {
+		t.Fatal(res, err, h.Genesis())
+	}
+	if h.Barrier() <= b[0] {
+		t.Fatal("barrier")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h, dir := testLog(t, Options{Sync: SyncAlways})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testlog")
+
+	keys := []string{}
+	for i := 0; i < 10; i++ {
+		keys = append(keys, strings.Repeat(strconv.Itoa(i), i*4+1))
+		h.GetTimestampForKey([]byte(keys[i]))
+	}
+	// Keys with more than 12 bytes in the last block have a separate checksum block
+	if h.Size() != 20*blockSize {
+		t.Fatal(h.Size())
+	}
+	h.Close()
+
+	reopen := func(records int, size int64) *Handler {
+		h, err := Open(path, Options{Sync: SyncInterval})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, s := h.Recovered(); r != records || s != size {
+			t.Fatal("recovered:", r, s)
+		}
+		return h
+	}
+	appendRaw := func(p []byte) {
+		f, _ := os.OpenFile(segmentPath(path, 0), os.O_WRONLY|os.O_APPEND, 0)
+		f.Write(p)
+		f.Close()
+	}
+	block := func(ts int64, key string) []byte {
+		p := make([]byte, blockSize)
+		binary.BigEndian.PutUint64(p, uint64(ts)|uint64(len(key))<<56)
+		copy(p[8:], key)
+		return p
+	}
+
+	// A record without checksum and a partial block
+	appendRaw(append(block(clock.Timestamp(), "torn"), 1, 2, 3))
+	h = reopen(1, blockSize+3)
+	if res, err := readAll(h); err != nil || strings.Join(res, ",") != strings.Join(keys, ",") {
+		t.Fatal(res, err)
+	}
+	h.GetTimestampForKey([]byte("new"))
+	keys = append(keys, "new")
+	h.Close()
+
+	// Zeros after a crash
+	appendRaw(make([]byte, blockSize*3))
+	h = reopen(1, blockSize*3)
+	if res, err := readAll(h); err != nil || len(res) != len(keys) {
+		t.Fatal(res, err)
+	}
+
+	// Corrupted records are detected by readers, and discarded when reopening if they are at the tail
+	// The last two records: keys[9] in 3 blocks and "new" in 1 block, both with inline checksums
+	corrupt := func(off int64) {
+		f, _ := os.OpenFile(segmentPath(path, 0), os.O_WRONLY, 0)
+		f.WriteAt([]byte("x"), off)
+		f.Close()
+	}
+	corrupt(h.Size() - blockSize + 8)
+	if res, err := readAll(h); err == nil || len(res) != 10 {
+		t.Fatal(res, err)
+	}
+	h.Close()
+	h = reopen(1, blockSize)
+	if res, err := readAll(h); err != nil || strings.Join(res, ",") != strings.Join(keys[:10], ",") {
+		t.Fatal(res, err)
+	}
+
+	// Corruption followed by valid records is reported instead of being truncated
+	corrupt(h.Size() - 6*blockSize + 8) // keys[8]
+	if res, err := readAll(h); err == nil || len(res) != 8 {
+		t.Fatal(res, err)
+	}
+	h.Close()
+	if _, err := Open(path, Options{}); err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(segmentPath(path, 0)); fi.Size() != 20*blockSize {
+		t.Fatal("truncated:", fi.Size())
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testlog")
+
+	// Logs written before segments and checksums
+	buf := []byte{}
+	for i := 0; i < 5; i++ {
+		p := make([]byte, blockSize)
+		binary.BigEndian.PutUint64(p, uint64(clock.Timestamp())|1<<56)
+		p[8] = byte('a' + i)
+		buf = append(buf, p...)
+	}
+	ioutil.WriteFile(path, buf, 0644)
+
+	h, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if r, _ := h.Recovered(); r != 0 {
+		t.Fatal("recovered:", r)
+	}
+	h.GetTimestampForKey([]byte("f"))
+
+	c, _ := h.GetCursor(0)
+	defer c.Close()
+	res := ""
+	for ; !c.End(); c.Next() {
+		_, key, err := c.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res += string(key)
+	}
+	if res != "abcdef" {
+		t.Fatal(res)
+	}
+}
+
 func BenchmarkCursor(b *testing.B) {
-	h, _ := Open("testlog")
+	h, dir := testLog(b, Options{SegmentSize: 1 << 20})
+	defer os.RemoveAll(dir)
+	defer h.Close()
+	for i := 0; i < 100000; i++ {
+		h.GetTimestampForKey([]byte(strconv.Itoa(i)))
+	}
+
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		h.GetCursor(clock.Timestamp() - 3600<<24)
+		if c, err := h.GetCursor(clock.Timestamp() - 3600<<24); err == nil {
+			c.Close()
+		}
 	}
 }
@@ -0,0 +1,170 @@
+package filelog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// recoverSegment scans all records of the segment and truncates the torn tail after the last valid one.
+// A record is valid if its checksum (inline or in the following block) matches it, or, for records written before
+// checksums were introduced, by another record. It returns the number of records and bytes discarded.
+// Invalid data followed by valid records is not a torn tail but corruption, which is returned as an error
+func recoverSegment(f *os.File) (int, int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	total := fi.Size()
+
+	var (
+		r       = bufio.NewReaderSize(io.NewSectionReader(f, 0, total), 1<<20)
+		buf     = make([]byte, blockSize)
+		valid   int64 // end of the last valid record
+		prev    int64 // timestamp of the last valid record
+		checked bool  // whether the segment has checksums
+		rec     int   // number of blocks of the pending record
+		recTs   int64
+		crc     uint32
+	)
+
+	for off := int64(0); ; off += blockSize {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			break
+		}
+		if validBlock(buf) != nil {
+			break
+		}
+		ts, flag := blockTs(buf), blockFlag(buf)
+
+		if rec > 0 && ts == recTs {
+			stored := uint32(0)
+			if flag&checksumFlag != 0 {
+				stored = binary.BigEndian.Uint32(buf[8:])
+			} else {
+				rec++
+				crc = blockChecksum(crc, buf)
+				if flag&inlineChecksumFlag == 0 {
+					continue
+				}
+				stored = inlineChecksum(buf)
+			}
+			if stored != crc {
+				rec = 0
+				break
+			}
+			valid, prev, checked, rec = off+blockSize, ts, true, 0
+			continue
+		}
+
+		if rec > 0 {
+			// The pending record has no checksum, it is fine only before checksums were introduced
+			if checked {
+				break
+			}
+			valid, prev, rec = off, recTs, 0
+		}
+		if flag&checksumFlag != 0 || ts <= prev {
+			break
+		}
+		rec, recTs, crc = 1, ts, blockChecksum(0, buf)
+		if flag&inlineChecksumFlag != 0 {
+			if inlineChecksum(buf) != crc {
+				rec = 0
+				break
+			}
+			valid, prev, checked, rec = off+blockSize, ts, true, 0
+		}
+	}
+
+	if rec > 0 && !checked {
+		// Can't tell a record without checksum at the tail from a torn one, keep it as it used to be
+		valid += int64(rec) * blockSize
+	}
+	if valid == total {
+		return 0, 0, nil
+	}
+	if ok, err := checksummedAfter(f, valid, total); err != nil {
+		return 0, 0, err
+	} else if ok {
+		return 0, 0, fmt.Errorf("corrupted data at %v, followed by valid records", valid)
+	}
+
+	records, err := countRecords(f, valid, total)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := f.Truncate(valid); err != nil {
+		return 0, 0, err
+	}
+	return records, total - valid, f.Sync()
+}
+
+// checksummedAfter returns whether there is any record with a matching checksum between start and end
+func checksummedAfter(f *os.File, start, end int64) (bool, error) {
+	var (
+		r     = bufio.NewReaderSize(io.NewSectionReader(f, start, end-start), 1<<20)
+		buf   = make([]byte, blockSize)
+		rec   bool
+		recTs int64
+		crc   uint32
+	)
+	for {
+		if _, err := io.ReadFull(r, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if validBlock(buf) != nil {
+			rec = false
+			continue
+		}
+		ts, flag := blockTs(buf), blockFlag(buf)
+
+		if rec && ts == recTs && flag&checksumFlag != 0 {
+			if binary.BigEndian.Uint32(buf[8:]) == crc {
+				return true, nil
+			}
+			rec = false
+			continue
+		}
+		if flag&checksumFlag != 0 {
+			rec = false
+			continue
+		}
+		if !rec || ts != recTs {
+			rec, recTs, crc = true, ts, 0
+		}
+		crc = blockChecksum(crc, buf)
+		if flag&inlineChecksumFlag != 0 {
+			if inlineChecksum(buf) == crc {
+				return true, nil
+			}
+			rec = false
+		}
+	}
+}
+
+// countRecords returns the number of records between start and end, a partial block counts as one
+// record if there are no whole blocks
+func countRecords(f *os.File, start, end int64) (int, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, start, end-start))
+	buf := make([]byte, blockSize)
+	records, last := 0, int64(-1)
+	for {
+		if _, err := io.ReadFull(r, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if ts := blockTs(buf); ts != last {
+			records, last = records+1, ts
+		}
+	}
+	if records == 0 && end > start {
+		records = 1
+	}
+	return records, nil
+}
@@ -0,0 +1,45 @@
+package gouch
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ReplicationFilter limits keys pulled from a peer, it is configured on the pulling side
+// as query params of the peer address: 'http://node1@host:port?include=tenant42/&exclude=tenant42/tmp/'
+type ReplicationFilter struct {
+	Include []string `json:"include,omitempty"` // key prefixes to replicate, empty means all
+	Exclude []string `json:"exclude,omitempty"` // key prefixes not to replicate, even if included
+}
+
+func parseFilter(q url.Values) ReplicationFilter {
+	return ReplicationFilter{Include: q["include"], Exclude: q["exclude"]}
+}
+
+func (f ReplicationFilter) values() url.Values {
+	q := url.Values{}
+	for _, p := range f.Include {
+		q.Add("include", p)
+	}
+	for _, p := range f.Exclude {
+		q.Add("exclude", p)
+	}
+	return q
+}
+
+func (f ReplicationFilter) match(key string) bool {
+	for _, p := range f.Exclude {
+		if strings.HasPrefix(key, p) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, p := range f.Include {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
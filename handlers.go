@@ -1,12 +1,42 @@
-package main
+package gouch
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/coyove/gouch/clock"
+	"github.com/gogo/protobuf/proto"
 )
 
+// RegisterHandlers registers the node's HTTP API on mux
+func (n *Node) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/", n.httpInfo)
+	mux.HandleFunc("/put", n.httpPut)
+	mux.HandleFunc("/delete", n.httpDelete)
+	mux.HandleFunc("/batch", n.httpBatch)
+	mux.HandleFunc("/get/", n.httpGet)
+	mux.HandleFunc("/mget", n.httpGetMany)
+	mux.HandleFunc("/range", n.httpRange)
+	mux.HandleFunc("/resolve", n.httpResolve)
+	mux.HandleFunc("/replicate", n.httpReplicate)
+	mux.HandleFunc("/snapshot", n.httpSnapshot)
+	mux.HandleFunc("/antientropy/tree", n.httpMerkleTree)
+	mux.HandleFunc("/antientropy/keys", n.httpMerkleKeys)
+	mux.HandleFunc("/antientropy/pairs", n.httpMerklePairs)
+	mux.HandleFunc("/admin/repair", n.httpRepair)
+	mux.HandleFunc("/admin/peers", n.httpPeers)
+	mux.HandleFunc("/admin/peers/add", n.httpPeers)
+	mux.HandleFunc("/admin/peers/update", n.httpPeers)
+	mux.HandleFunc("/admin/peers/remove", n.httpPeers)
+	mux.HandleFunc("/admin/acl/reload", n.httpReloadACL)
+}
+
 func getKey(r *http.Request) string {
 	p := r.URL.Path
 	if strings.HasSuffix(p, "/") {
@@ -19,66 +49,267 @@ func getKey(r *http.Request) string {
 	return p[idx+1:]
 }
 
-func httpPut(w http.ResponseWriter, r *http.Request) {
+// getContext returns the causal context in 'ctx', see PutContext
+func getContext(r *http.Request) (int64, bool, error) {
+	v := r.FormValue("ctx")
+	if v == "" {
+		return 0, false, nil
+	}
+	ctx, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid ctx: %q", v)
+	}
+	return ctx, true, nil
+}
+
+// getIfVer returns the expected version in 'if_ver', if_ver=0 means the key must not exist
+func getIfVer(r *http.Request) (int64, bool, error) {
+	v := r.FormValue("if_ver")
+	if v == "" {
+		return 0, false, nil
+	}
+	ver, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid if_ver: %q", v)
+	}
+	return ver, true, nil
+}
+
+// getAsOf returns the time to read at in 'as_of', 0 if not provided
+func getAsOf(r *http.Request) (int64, error) {
+	v := r.FormValue("as_of")
+	if v == "" {
+		return 0, nil
+	}
+	asOf, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid as_of: %q", v)
+	}
+	return asOf, nil
+}
+
+func writeWriteError(w http.ResponseWriter, r *http.Request, ts int64, err error) {
+	if err == ErrConflict {
+		writeJSONCode(w, r, http.StatusConflict, "error", true, "conflict", true, "msg", err.Error(), "ver", ts)
+		return
+	}
+	writeJSON(w, r, "error", true, "msg", err.Error())
+}
+
+func (n *Node) httpInfo(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeJSON(w, r, "msg", "invalid URL path: "+r.RequestURI, "error", true)
+		return
+	}
+	if _, ok := n.authorize(w, r, PermAdmin, ""); !ok {
+		return
+	}
+	m := n.Info()
+	m["node_listen"] = n.listen
+	writeJSON(w, r, "data", m, "ok", true)
+}
+
+func (n *Node) httpPut(w http.ResponseWriter, r *http.Request) {
 	key, value := r.FormValue("key"), r.FormValue("value")
 	if key == "" {
 		writeJSON(w, r, "error", true, "msg", "empty key")
 		return
 	}
+	if _, ok := n.authorize(w, r, PermWrite, key); !ok {
+		return
+	}
+
+	ctx, hasCtx, err := getContext(r)
+	if err != nil {
+		writeJSONCode(w, r, http.StatusBadRequest, "error", true, "msg", err.Error())
+		return
+	}
+	ifVer, hasIfVer, err := getIfVer(r)
+	if err != nil {
+		writeJSONCode(w, r, http.StatusBadRequest, "error", true, "msg", err.Error())
+		return
+	}
 
 	start := time.Now()
 
-	ts, err := nn.Put(key, []byte(value), r.FormValue("append") != "")
+	var ts int64
+	if hasIfVer {
+		ts, err = n.PutIf(key, []byte(value), r.FormValue("append") != "", ifVer)
+	} else if hasCtx {
+		if r.FormValue("append") != "" {
+			writeJSON(w, r, "error", true, "msg", "can't append with a causal context")
+			return
+		}
+		ts, err = n.PutContext(key, []byte(value), ctx)
+	} else {
+		ts, err = n.Put(key, []byte(value), r.FormValue("append") != "")
+	}
 	if err != nil {
-		writeJSON(w, r, "error", true, "msg", err.Error())
+		writeWriteError(w, r, ts, err)
 		return
 	}
 	writeJSON(w, r, "ok", true, "cost", time.Since(start).Seconds(), "ver", ts)
 }
 
-func httpDelete(w http.ResponseWriter, r *http.Request) {
+func (n *Node) httpDelete(w http.ResponseWriter, r *http.Request) {
 	key := r.FormValue("key")
 	if key == "" {
 		writeJSON(w, r, "error", true, "msg", "empty key")
 		return
 	}
+	if _, ok := n.authorize(w, r, PermDelete, key); !ok {
+		return
+	}
+
+	ctx, hasCtx, err := getContext(r)
+	if err != nil {
+		writeJSONCode(w, r, http.StatusBadRequest, "error", true, "msg", err.Error())
+		return
+	}
+	ifVer, hasIfVer, err := getIfVer(r)
+	if err != nil {
+		writeJSONCode(w, r, http.StatusBadRequest, "error", true, "msg", err.Error())
+		return
+	}
 
 	start := time.Now()
-	ts, err := nn.Delete(key)
+	var ts int64
+	if hasIfVer {
+		ts, err = n.DeleteIf(key, ifVer)
+	} else if hasCtx {
+		ts, err = n.DeleteContext(key, ctx)
+	} else {
+		ts, err = n.Delete(key)
+	}
 	if err != nil {
-		writeJSON(w, r, "error", true, "msg", err.Error())
+		writeWriteError(w, r, ts, err)
+		return
+	}
+	writeJSON(w, r, "ok", true, "cost", time.Since(start).Seconds(), "ver", ts)
+}
+
+func (n *Node) httpResolve(w http.ResponseWriter, r *http.Request) {
+	key, value := r.FormValue("key"), r.FormValue("value")
+	if key == "" {
+		writeJSON(w, r, "error", true, "msg", "empty key")
+		return
+	}
+
+	perm := PermWrite
+	if r.FormValue("delete") != "" {
+		perm = PermDelete
+	}
+	if _, ok := n.authorize(w, r, perm, key); !ok {
+		return
+	}
+
+	ctx, _, err := getContext(r)
+	if err != nil {
+		writeJSONCode(w, r, http.StatusBadRequest, "error", true, "msg", err.Error())
+		return
+	}
+
+	start := time.Now()
+	var ts int64
+	if r.FormValue("delete") != "" {
+		ts, err = n.Resolve(key, deletionUUID, ctx)
+	} else {
+		ts, err = n.Resolve(key, []byte(value), ctx)
+	}
+	if err != nil {
+		writeWriteError(w, r, ts, err)
 		return
 	}
 	writeJSON(w, r, "ok", true, "cost", time.Since(start).Seconds(), "ver", ts)
 }
 
-func httpGet(w http.ResponseWriter, r *http.Request) {
+func (n *Node) httpBatch(w http.ResponseWriter, r *http.Request) {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, r, "error", true, "msg", err.Error())
+		return
+	}
+
+	b := &Batch{}
+	if strings.Contains(r.Header.Get("Content-Type"), "protobuf") {
+		err = proto.Unmarshal(buf, b)
+	} else {
+		err = json.Unmarshal(buf, b)
+	}
+	if err != nil {
+		writeJSON(w, r, "error", true, "msg", "invalid batch: "+err.Error())
+		return
+	}
+
+	writes, deletes := []string{}, []string{}
+	for _, op := range b.Ops {
+		if op.Delete {
+			deletes = append(deletes, op.Key)
+		} else {
+			writes = append(writes, op.Key)
+		}
+	}
+	if _, ok := n.authorize(w, r, PermWrite, writes...); !ok {
+		return
+	}
+	if _, ok := n.authorize(w, r, PermDelete, deletes...); !ok {
+		return
+	}
+
+	start := time.Now()
+	vers, err := n.Batch(b.Ops)
+	if err != nil {
+		writeJSON(w, r, "error", true, "msg", err.Error())
+		return
+	}
+	writeJSON(w, r, "ok", true, "cost", time.Since(start).Seconds(), "vers", vers)
+}
+
+func (n *Node) httpGet(w http.ResponseWriter, r *http.Request) {
 	key := getKey(r)
 	if key == "" {
 		writeJSON(w, r, "error", true, "msg", "empty key")
 		return
 	}
+	if _, ok := n.authorize(w, r, PermRead, key); !ok {
+		return
+	}
 
 	ver, err := strconv.ParseInt(r.FormValue("ver"), 10, 64)
-	n, err := strconv.ParseInt(r.FormValue("n"), 10, 64)
+	count, err := strconv.ParseInt(r.FormValue("n"), 10, 64)
+	asOf, err := getAsOf(r)
+	if err != nil {
+		writeJSONCode(w, r, http.StatusBadRequest, "error", true, "msg", err.Error())
+		return
+	}
 	start := time.Now()
 
 	if r.FormValue("all_versions") != "" {
-		if n == 0 {
-			n = 100
+		if count == 0 {
+			count = 100
 		}
-		res, next, err := nn.GetAllVersions(key, ver, int(n), r.FormValue("key_only") != "")
+		res, next, err := n.GetAllVersions(key, ver, int(count), r.FormValue("key_only") != "")
 		if err != nil {
 			writeJSON(w, r, "error", true, "msg", err.Error())
 			return
 		}
 		writeJSON(w, r, "ok", true, "cost", time.Since(start).Seconds(), "data", res, "next", next)
+	} else if r.FormValue("conflicts") != "" {
+		res, err := n.GetSiblings(key)
+		if err != nil {
+			writeJSON(w, r, "error", true, "not_found", err == ErrNotFound, "msg", err.Error())
+			return
+		}
+		writeJSON(w, r, "ok", true, "cost", time.Since(start).Seconds(),
+			"data", res[0], "siblings", res, "conflict", len(res) > 1)
 	} else {
 		var v Entry
 		if ver > 0 {
-			v, err = nn.GetVersion(key, ver)
+			v, err = n.GetVersion(key, ver)
+		} else if asOf > 0 {
+			v, err = n.GetAt(key, asOf)
 		} else {
-			v, err = nn.Get(key)
+			v, err = n.Get(key)
 		}
 		if err != nil {
 			writeJSON(w, r, "error", true, "not_found", err == ErrNotFound, "msg", err.Error())
@@ -95,14 +326,79 @@ func httpGet(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func httpReplicate(w http.ResponseWriter, r *http.Request) {
+func (n *Node) httpGetMany(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	keys := r.Form["key"]
+
+	if strings.Contains(r.Header.Get("Content-Type"), "json") {
+		body := struct {
+			Keys []string `json:"keys"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSON(w, r, "error", true, "msg", "invalid body: "+err.Error())
+			return
+		}
+		keys = append(keys, body.Keys...)
+	}
+
+	if len(keys) == 0 {
+		writeJSON(w, r, "error", true, "msg", "empty keys")
+		return
+	}
+	if _, ok := n.authorize(w, r, PermRead, keys...); !ok {
+		return
+	}
+
+	start := time.Now()
+	res, err := n.GetMany(keys)
+	if err != nil {
+		writeJSON(w, r, "error", true, "msg", err.Error())
+		return
+	}
+	writeJSON(w, r, "ok", true, "cost", time.Since(start).Seconds(), "data", res)
+}
+
+// httpReplicate serves changes since 'ver', if 'wait' is set and there are no changes,
+// the request will be held until new records are logged or the duration elapses
+func (n *Node) httpReplicate(w http.ResponseWriter, r *http.Request) {
+	if !n.authorizePeer(w, r) {
+		return
+	}
+
 	ver, _ := strconv.ParseInt(r.FormValue("ver"), 10, 64)
-	n, _ := strconv.Atoi(r.FormValue("n"))
-	if n == 0 {
-		n = 100
+	count, _ := strconv.Atoi(r.FormValue("n"))
+	if count == 0 {
+		count = 100
+	}
+
+	r.ParseForm()
+	filter := parseFilter(r.Form)
+
+	wait, _ := time.ParseDuration(r.FormValue("wait"))
+	if wait > maxReplicationWait {
+		wait = maxReplicationWait
+	}
+	timeout := time.After(wait)
+
+	var res *Pairs
+	var err error
+	for {
+		// Get the channel before reading the log, so no records will be missed
+		changed := n.log.Changed()
+		res, err = n.GetFilteredKeysSince(ver, count, filter)
+		if err != nil || res.Next > 0 || wait <= 0 {
+			break
+		}
+		select {
+		case <-changed:
+			continue
+		case <-timeout:
+		case <-r.Context().Done():
+		case <-n.closed:
+		}
+		break
 	}
 
-	res, err := nn.GetChangedKeysSince(ver, n)
 	if err != nil {
 		w.Header().Add("X-Error", "true")
 		w.Header().Add("X-Msg", err.Error())
@@ -110,30 +406,55 @@ func httpReplicate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Checkpoints allow truncating the log and purging tombstones. Requests here are signed by peers,
+	// from admins if ACL is enabled, or from anyone if neither is enabled, see authorizePeer and NewNode
 	if nodename := r.FormValue("me"); nodename != "" {
-		f := nn.friends.states[nodename]
+		n.friends.Lock()
+		f := n.friends.states[nodename]
 		if f != nil {
 			f.RevCheckpoint = f.RevCheckpointTmp
 			f.RevCheckpointTmp = ver
 		}
+		n.friends.Unlock()
 	}
 
 	writeProtobuf(w, r, res)
 }
 
-func httpRange(w http.ResponseWriter, r *http.Request) {
+func (n *Node) httpRange(w http.ResponseWriter, r *http.Request) {
 	key := r.FormValue("key")
-	n, _ := strconv.Atoi(r.FormValue("n"))
-	if n <= 0 {
+	count, _ := strconv.Atoi(r.FormValue("n"))
+	if count <= 0 {
 		writeJSON(w, r, "error", true, "msg", "missing 'n'")
 		return
 	}
 
+	p, ok := n.authorize(w, r, PermRead)
+	if !ok {
+		return
+	}
+	if !p.canAny(PermRead) {
+		// Nothing is readable, deny it rather than scanning all keys for nothing
+		n.authorize(w, r, PermRead, key)
+		return
+	}
+
+	asOf, err := getAsOf(r)
+	if err != nil {
+		writeJSONCode(w, r, http.StatusBadRequest, "error", true, "msg", err.Error())
+		return
+	}
+	if asOf <= 0 {
+		asOf = clock.Timestamp()
+	}
+
 	start := time.Now()
-	res, next, err := nn.Range(key, r.FormValue("end_key"), n,
+	res, next, err := n.rangeAt(key, r.FormValue("end_key"), count,
 		r.FormValue("key_only") != "",
 		r.FormValue("include_deleted") != "",
-		r.FormValue("desc") != "")
+		r.FormValue("desc") != "",
+		asOf,
+		func(key string) bool { return p.can(PermRead, key) })
 	if err != nil {
 		writeJSON(w, r, "error", true, "msg", err.Error())
 		return
@@ -141,3 +462,169 @@ func httpRange(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, r, "ok", true, "cost", time.Since(start).Seconds(), "next", next, "data", res)
 }
+
+func (n *Node) httpMerkleTree(w http.ResponseWriter, r *http.Request) {
+	if !n.authorizePeer(w, r) {
+		return
+	}
+
+	since, _ := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	keep, _ := strconv.Atoi(r.FormValue("keep"))
+	level, _ := strconv.Atoi(r.FormValue("level"))
+	if level < 0 || level > merkleDepth {
+		writeJSON(w, r, "error", true, "msg", "invalid level")
+		return
+	}
+
+	tree, err := n.MerkleTree(since, keep)
+	if err != nil {
+		writeJSON(w, r, "error", true, "msg", err.Error())
+		return
+	}
+
+	// Only the requested nodes of the level, or all of them
+	hashes := tree[level]
+	if r.FormValue("nodes") != "" {
+		hashes = []uint64{}
+		for _, i := range splitInts(r.FormValue("nodes")) {
+			if i < 0 || i >= len(tree[level]) {
+				writeJSON(w, r, "error", true, "msg", "invalid node")
+				return
+			}
+			hashes = append(hashes, tree[level][i])
+		}
+	}
+	writeJSON(w, r, "ok", true, "hashes", hashes)
+}
+
+func (n *Node) httpMerkleKeys(w http.ResponseWriter, r *http.Request) {
+	if !n.authorizePeer(w, r) {
+		return
+	}
+
+	since, _ := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	keep, _ := strconv.Atoi(r.FormValue("keep"))
+	leaves := map[int]bool{}
+	for _, i := range splitInts(r.FormValue("leaves")) {
+		leaves[i] = true
+	}
+
+	keys, err := n.merkleKeys(since, keep, leaves)
+	if err != nil {
+		w.Header().Add("X-Error", "true")
+		w.Header().Add("X-Msg", err.Error())
+		writeProtobuf(w, r, nil)
+		return
+	}
+
+	res := &Pairs{NodeInternalName: n.InternalName()}
+	for _, k := range keys {
+		res.Data = append(res.Data, Pair{Key: k})
+	}
+	writeProtobuf(w, r, res)
+}
+
+func (n *Node) httpMerklePairs(w http.ResponseWriter, r *http.Request) {
+	if !n.authorizePeer(w, r) {
+		return
+	}
+
+	req := &Pairs{}
+	buf, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = proto.Unmarshal(buf, req)
+	}
+
+	var res *Pairs
+	if err == nil {
+		keys := make([][]byte, len(req.Data))
+		for i, p := range req.Data {
+			keys[i] = p.Key
+		}
+		res, err = n.getPairs(keys)
+	}
+
+	if err != nil {
+		w.Header().Add("X-Error", "true")
+		w.Header().Add("X-Msg", err.Error())
+		writeProtobuf(w, r, nil)
+		return
+	}
+	writeProtobuf(w, r, res)
+}
+
+func (n *Node) httpRepair(w http.ResponseWriter, r *http.Request) {
+	if _, ok := n.authorize(w, r, PermAdmin, ""); !ok {
+		return
+	}
+
+	peer := r.FormValue("peer")
+	if peer == "" {
+		writeJSON(w, r, "error", true, "msg", "empty peer")
+		return
+	}
+
+	res, err := n.Repair(peer)
+	if err != nil {
+		writeJSON(w, r, "error", true, "msg", err.Error(), "data", res)
+		return
+	}
+	writeJSON(w, r, "ok", true, "data", res)
+}
+
+func (n *Node) httpPeers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := n.authorize(w, r, PermAdmin, ""); !ok {
+		return
+	}
+
+	// Membership changes must not be triggered by prefetches or crawlers
+	if r.URL.Path != "/admin/peers" && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONCode(w, r, http.StatusMethodNotAllowed, "error", true, "msg", "POST required")
+		return
+	}
+
+	name, addr := r.FormValue("name"), r.FormValue("addr")
+
+	var err error
+	switch r.URL.Path {
+	case "/admin/peers/add":
+		err = n.AddPeer(name, addr)
+	case "/admin/peers/update":
+		err = n.UpdatePeer(name, addr)
+	case "/admin/peers/remove":
+		err = n.RemovePeer(name)
+	}
+	if err != nil {
+		writeJSON(w, r, "error", true, "msg", err.Error())
+		return
+	}
+	writeJSON(w, r, "ok", true, "data", n.Peers())
+}
+
+func (n *Node) httpSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !n.authorizePeer(w, r) {
+		return
+	}
+
+	// Checkpoints are read before the snapshot is taken, so everything before them is in the snapshot
+	buf, _ := json.Marshal(n.SnapshotCheckpoints())
+	w.Header().Add("X-Snapshot-Checkpoints", string(buf))
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("X-Server", "gouch")
+
+	if err := n.WriteSnapshot(w); err != nil {
+		log.Println("WARN: write snapshot error:", err)
+	}
+}
+
+func (n *Node) httpReloadACL(w http.ResponseWriter, r *http.Request) {
+	if _, ok := n.authorize(w, r, PermAdmin, ""); !ok {
+		return
+	}
+	if err := n.ReloadACL(); err != nil {
+		writeJSON(w, r, "error", true, "msg", err.Error())
+		return
+	}
+	writeJSON(w, r, "ok", true)
+}
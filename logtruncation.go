@@ -0,0 +1,80 @@
+package gouch
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCheckpointTooOld is returned to peers asking for changes which have been truncated from the log
+var ErrCheckpointTooOld = fmt.Errorf("checkpoint too old, resync via snapshot")
+
+// LogTruncation controls how the write log is truncated once all peers have replicated it
+type LogTruncation struct {
+	// Interval is the interval between two background truncations, 0 disables.
+	// Without replication keys or ACL, anyone can claim to be a peer which has replicated everything
+	Interval time.Duration
+
+	// Margin keeps log entries newer than the minimal checkpoint of peers minus Margin,
+	// so peers restored from slightly older states can still catch up
+	Margin time.Duration
+}
+
+type logTruncationState struct {
+	sync.Mutex
+	LogTruncation
+	LastRunAt time.Time
+	Horizon   int64
+	Dropped   int64
+	LastError string
+}
+
+func (n *Node) logTruncationWorker() {
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-time.After(n.logTruncation.Interval):
+		}
+
+		if _, err := n.TruncateLog(); err != nil {
+			log.Println("WARN: truncate log error:", err)
+		}
+	}
+}
+
+// TruncateLog drops log segments whose entries are all before the minimal checkpoint of peers
+// minus the margin, peers asking for them later will get ErrCheckpointTooOld.
+// It returns the number of segments dropped
+func (n *Node) TruncateLog() (int, error) {
+	if !n.track() {
+		return 0, ErrClosed
+	}
+	defer n.jobs.Done()
+
+	lt := &n.logTruncation
+	start := time.Now()
+
+	horizon := n.gcHorizon()
+	if horizon > 0 {
+		horizon -= int64(lt.Margin/time.Second) << 20
+	}
+
+	dropped := 0
+	var err error
+	if horizon > 0 {
+		dropped, err = n.log.DropSegments(horizon)
+	}
+
+	lt.Lock()
+	defer lt.Unlock()
+	lt.LastRunAt = start
+	lt.Horizon = horizon
+	lt.Dropped += int64(dropped)
+	lt.LastError = ""
+	if err != nil {
+		lt.LastError = err.Error()
+	}
+	return dropped, err
+}
@@ -0,0 +1,82 @@
+package gouch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/coyove/gouch/filelog"
+)
+
+func TestTruncateLog(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	n := testNode(t, Options{
+		Driver: "memory",
+		Name:   "a",
+		Peers:  "http://a@127.0.0.1:1;http://b@127.0.0.1:2",
+		Mux:    mux,
+		Log:    filelog.Options{SegmentSize: 24 * 10},
+	})
+	defer closeTestNode(n)
+
+	tss := []int64{}
+	for i := 0; i < 50; i++ {
+		ts, err := n.Put("k"+strconv.Itoa(i), []byte("v"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tss = append(tss, ts)
+	}
+
+	// b has never pulled from us
+	if dropped, err := n.TruncateLog(); dropped != 0 || err != nil {
+		t.Fatal(dropped, err)
+	}
+
+	// b pulls from tss[35] twice, the first one only tells us it has everything before the previous pull
+	replicate := func(ver int64) *http.Response {
+		resp, err := http.Get(srv.URL + "/replicate?me=b&ver=" + strconv.FormatInt(ver, 10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	replicate(tss[35])
+	if dropped, err := n.TruncateLog(); dropped != 0 || err != nil {
+		t.Fatal(dropped, err)
+	}
+	replicate(tss[35])
+	if dropped, err := n.TruncateLog(); dropped != 3 || err != nil {
+		t.Fatal(dropped, err)
+	}
+	if n.log.Genesis() != tss[30] || n.log.Truncated() != tss[30] {
+		t.Fatal(n.log.Genesis(), tss[30])
+	}
+
+	if _, err := n.GetChangedKeysSince(tss[29], 10); err != ErrCheckpointTooOld {
+		t.Fatal(err)
+	}
+	p, err := n.GetChangedKeysSince(tss[30], 10)
+	if err != nil || len(p.Data) != 10 || string(p.Data[0].Key[:3]) != "k30" {
+		t.Fatal(p, err)
+	}
+
+	if resp := replicate(1); resp.Header.Get("X-Msg") != ErrCheckpointTooOld.Error() {
+		t.Fatal(resp.Header)
+	}
+
+	// Without peers, nothing is known to be replicated
+	x := testNode(t, Options{Driver: "memory", Name: "x", Log: filelog.Options{SegmentSize: 24 * 10}})
+	defer closeTestNode(x)
+	for i := 0; i < 50; i++ {
+		x.Put("k"+strconv.Itoa(i), []byte("v"), false)
+	}
+	if dropped, err := x.TruncateLog(); dropped != 0 || err != nil {
+		t.Fatal(dropped, err)
+	}
+}
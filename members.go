@@ -0,0 +1,198 @@
+package gouch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// peerOptions are options of a peer, provided as query params of its address
+type peerOptions struct {
+	Filter ReplicationFilter
+	secret string // see signRequest
+	token  string // see peerTransport
+}
+
+func (o peerOptions) encode(addr string, withSecret bool) string {
+	q := o.Filter.values()
+	if withSecret && o.secret != "" {
+		q.Set("secret", o.secret)
+	}
+	if withSecret && o.token != "" {
+		q.Set("token", o.token)
+	}
+	if len(q) > 0 {
+		addr += "?" + q.Encode()
+	}
+	return addr
+}
+
+// readMembers reads the membership persisted by peer changes at runtime, if there is one,
+// it replaces peers listed in the config. The file maps peer names to their addresses (with options)
+func (n *Node) readMembers() error {
+	buf, err := ioutil.ReadFile(filepath.Join(n.path, "members"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m := map[string]string{}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return err
+	}
+
+	contacts, options := map[string]string{}, map[string]peerOptions{}
+	for name, addr := range m {
+		addr, opts, err := validatePeer(name, addr)
+		if err != nil {
+			return err
+		}
+		contacts[name], options[name] = addr, opts
+	}
+	for name, addr := range n.friends.contacts {
+		if contacts[name] == "" {
+			log.Println("WARN: peer in the config is ignored, not in the members file:", name, addr)
+		} else if contacts[name] != addr {
+			log.Println("WARN: peer in the config is overridden by the members file:", name, addr, "->", contacts[name])
+		}
+	}
+	log.Println("members loaded:", len(contacts), "peers from", filepath.Join(n.path, "members"))
+	n.friends.contacts, n.friends.options = contacts, options
+	return nil
+}
+
+// writeMembers persists the membership, caller should hold the friends lock
+func (n *Node) writeMembers() error {
+	m := map[string]string{}
+	for name, addr := range n.friends.contacts {
+		m[name] = n.friends.options[name].encode(addr, true)
+	}
+	buf, _ := json.Marshal(m)
+	fn := filepath.Join(n.path, "members")
+	if err := ioutil.WriteFile(fn+".tmp", buf, 0600); err != nil { // It has peer secrets
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+// validatePeer validates the peer address, options can be provided as its query params:
+// filters (see ReplicationFilter), 'secret' (see signRequest) and 'token' (see peerTransport)
+func validatePeer(name, addr string) (string, peerOptions, error) {
+	if name == "" || strings.ContainsAny(name, ";@/") {
+		return "", peerOptions{}, fmt.Errorf("invalid peer name: %q", name)
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", peerOptions{}, fmt.Errorf("invalid peer address: %q", addr)
+	}
+	return u.Scheme + "://" + u.Host, parsePeerOptions(u.Query()), nil
+}
+
+func parsePeerOptions(q url.Values) peerOptions {
+	return peerOptions{Filter: parseFilter(q), secret: q.Get("secret"), token: q.Get("token")}
+}
+
+// Peers returns names and addresses (with filters, without secrets and tokens) of all peers
+func (n *Node) Peers() map[string]string {
+	n.friends.Lock()
+	defer n.friends.Unlock()
+	m := make(map[string]string, len(n.friends.contacts))
+	for k, v := range n.friends.contacts {
+		m[k] = n.friends.options[k].encode(v, false)
+	}
+	return m
+}
+
+// AddPeer adds the peer and starts replicating from it
+func (n *Node) AddPeer(name, addr string) error {
+	addr, opts, err := validatePeer(name, addr)
+	if err != nil {
+		return err
+	}
+	if name == n.Name {
+		return fmt.Errorf("can't add yourself")
+	}
+
+	n.friends.Lock()
+	defer n.friends.Unlock()
+	if n.friends.contacts[name] != "" {
+		return fmt.Errorf("peer %q already exists", name)
+	}
+	if !n.track() {
+		return ErrClosed
+	}
+
+	n.friends.contacts[name], n.friends.options[name] = addr, opts
+	if err := n.writeMembers(); err != nil {
+		delete(n.friends.contacts, name)
+		delete(n.friends.options, name)
+		n.jobs.Done()
+		return err
+	}
+
+	f := &repState{NodeName: name, stop: make(chan struct{})}
+	n.friends.states[name] = f
+	go n.replicationWorker(f)
+	log.Println("peer added:", name, addr)
+	return nil
+}
+
+// UpdatePeer changes the address and options of the peer, replication continues from its checkpoint
+func (n *Node) UpdatePeer(name, addr string) error {
+	addr, opts, err := validatePeer(name, addr)
+	if err != nil {
+		return err
+	}
+
+	n.friends.Lock()
+	defer n.friends.Unlock()
+	old := n.friends.contacts[name]
+	if old == "" {
+		return fmt.Errorf("peer %q not found", name)
+	}
+
+	oldOpts := n.friends.options[name]
+	n.friends.contacts[name], n.friends.options[name] = addr, opts
+	if err := n.writeMembers(); err != nil {
+		n.friends.contacts[name], n.friends.options[name] = old, oldOpts
+		return err
+	}
+
+	// The worker may be long polling the old address
+	if f := n.friends.states[name]; f != nil && f.cancel != nil {
+		f.cancel()
+	}
+	log.Println("peer updated:", name, addr)
+	return nil
+}
+
+// RemovePeer stops replicating from the peer and drops its replication state
+func (n *Node) RemovePeer(name string) error {
+	n.friends.Lock()
+	defer n.friends.Unlock()
+	old := n.friends.contacts[name]
+	if old == "" {
+		return fmt.Errorf("peer %q not found", name)
+	}
+
+	opts := n.friends.options[name]
+	delete(n.friends.contacts, name)
+	delete(n.friends.options, name)
+	if err := n.writeMembers(); err != nil {
+		n.friends.contacts[name], n.friends.options[name] = old, opts
+		return err
+	}
+
+	if f := n.friends.states[name]; f != nil {
+		close(f.stop)
+		delete(n.friends.states, name)
+	}
+	log.Println("peer removed:", name)
+	return nil
+}
@@ -0,0 +1,114 @@
+package gouch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMembership(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	b := testNode(t, Options{Driver: "memory", Name: "b", Mux: mux})
+	defer closeTestNode(b)
+
+	a := testNode(t, Options{Driver: "memory", Name: "a"})
+	defer os.RemoveAll(a.path)
+
+	// Membership changes require POST
+	q := url.Values{"name": {"z"}, "addr": {"http://127.0.0.1:1"}}
+	resp, err := http.Get(srv.URL + "/admin/peers/add?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || len(b.Peers()) != 0 {
+		t.Fatal(resp.StatusCode, b.Peers())
+	}
+	resp, err = http.PostForm(srv.URL+"/admin/peers/add", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(b.Peers()) != 1 {
+		t.Fatal(resp.StatusCode, b.Peers())
+	}
+	if err := b.RemovePeer("z"); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Put("k", []byte("v"), false)
+	if err := a.AddPeer("b", srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddPeer("b", srv.URL); err == nil {
+		t.Fatal("duplicated peer")
+	}
+	for i := 0; ; i++ {
+		if e, err := a.Get("k"); err == nil && e.Value == "v" {
+			break
+		}
+		if i > 100 {
+			t.Fatal("not replicated")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The long poll to the old address is dropped on update
+	mux2 := http.NewServeMux()
+	srv2 := httptest.NewServer(mux2)
+	defer srv2.Close()
+	c := testNode(t, Options{Driver: "memory", Name: "c", Mux: mux2})
+	defer closeTestNode(c)
+	c.Put("k2", []byte("v2"), false)
+	time.Sleep(100 * time.Millisecond)
+	if err := a.UpdatePeer("b", srv2.URL); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if e, err := a.Get("k2"); err == nil && e.Value == "v2" {
+			break
+		}
+		if i > 100 {
+			t.Fatal("still polling the old address")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := a.UpdatePeer("b", "http://127.0.0.1:1?include=t1%2F"); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if err := a.AddPeer("c", srv.URL); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(a.path, "members")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatal(fi, err)
+	}
+
+	// Membership survives restarts
+	a, err = NewNode(Options{Driver: "memory", Name: "a", DataDir: a.path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := a.Peers(); len(p) != 1 || p["b"] != "http://127.0.0.1:1?include=t1%2F" {
+		t.Fatal(p)
+	}
+
+	if f := a.friends.options["b"].Filter; len(f.Include) != 1 || f.Include[0] != "t1/" {
+		t.Fatal(f)
+	}
+
+	if err := a.RemovePeer("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Peers()) != 0 || len(a.friends.states) != 0 {
+		t.Fatal(a.Peers(), a.friends.states)
+	}
+	a.Close()
+}
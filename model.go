@@ -1,4 +1,4 @@
-package main
+package gouch
 
 import (
 	"bytes"
@@ -13,6 +13,8 @@ import (
 var (
 	deletionUUID = []byte{0x91, 0xee, 0x48, 0xda, 0x52, 0x75, 0x4e, 0xc7, 0xa5, 0x76, 0xcb, 0x80, 0xad, 0x1c, 0x12, 0x03}
 	appendUUID   = []byte{0x92, 0xef, 0x49, 0xdb, 0x53, 0x76, 0x4f, 0xc8, 0xa6, 0x77, 0xcc, 0x81, 0xae, 0x1d, 0x13, 0x04}
+	contextUUID  = []byte{0x93, 0xf0, 0x4a, 0xdc, 0x54, 0x77, 0x50, 0xc9, 0xa7, 0x78, 0xcd, 0x82, 0xaf, 0x1e, 0x14, 0x05}
+	compactUUID  = []byte{0x94, 0xf1, 0x4b, 0xdd, 0x55, 0x78, 0x51, 0xca, 0xa8, 0x79, 0xce, 0x83, 0xb0, 0x1f, 0x15, 0x06}
 )
 
 type Entry struct {
@@ -25,9 +27,54 @@ type Entry struct {
 	Future   bool      `json:"future,omitempty"`
 	Deleted  bool      `json:"deleted,omitempty"`
 	Append   bool      `json:"append,omitempty"`
+	NotFound bool      `json:"not_found,omitempty"`
+
+	Siblings []Entry `json:"siblings,omitempty"` // see ResolveSiblings
+}
+
+func appendedValue(v []byte) []byte {
+	newv := make([]byte, len(v)+16)
+	copy(newv[:], appendUUID)
+	copy(newv[16:], v)
+	return newv
+}
+
+// contextValue prefixes the value with the causal context, see PutContext
+func contextValue(v []byte, ctx int64) []byte {
+	newv := make([]byte, len(v)+24)
+	copy(newv[:], contextUUID)
+	binary.BigEndian.PutUint64(newv[16:], uint64(ctx))
+	copy(newv[24:], v)
+	return newv
+}
+
+// compactedValue prefixes the value consolidated from an append chain, see CompactAppends
+func compactedValue(v []byte) []byte {
+	newv := make([]byte, len(v)+16)
+	copy(newv[:], compactUUID)
+	copy(newv[16:], v)
+	return newv
+}
+
+// splitCompacted strips the compaction prefix from the value, ok is false if it is not compacted
+func splitCompacted(v []byte) ([]byte, bool) {
+	if bytes.HasPrefix(v, compactUUID) {
+		return v[16:], true
+	}
+	return v, false
+}
+
+// splitContext splits the causal context from the value, ctx is 0 if there is none
+func splitContext(v []byte) ([]byte, int64) {
+	if len(v) >= 24 && bytes.HasPrefix(v, contextUUID) {
+		return v[24:], int64(binary.BigEndian.Uint64(v[16:]))
+	}
+	return v, 0
 }
 
 func createEntry(k, v []byte, keyOnly bool) (e Entry) {
+	v, _ = splitContext(v)
+	v, _ = splitCompacted(v)
 	e.ValueLen, e.Deleted, e.Append =
 		int64(len(v)),
 		bytes.Equal(v, deletionUUID),
@@ -1,8 +1,9 @@
-package main
+package gouch
 
 import (
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/gouch/clock"
@@ -10,6 +11,7 @@ import (
 
 func (n *Node) Info() map[string]interface{} {
 	start := time.Unix(clock.UnixSecFromTimestamp(n.startAt), 0)
+	records, size := n.log.Recovered()
 	m := map[string]interface{}{
 		"node_start_at":      start,
 		"node_start_at_ts":   n.startAt,
@@ -20,6 +22,8 @@ func (n *Node) Info() map[string]interface{} {
 		"node_genesis":       n.log.Genesis(),
 		"log_size":           n.log.Size(),
 		"log_size_human":     fmt.Sprintf("%.3fG", float64(n.log.Size())/1024/1024/1024),
+		"log_segments":       n.log.Segments(),
+		"log_recovered":      map[string]int64{"records": int64(records), "bytes": size},
 		"db_stat":            n.db.Info(),
 	}
 
@@ -41,8 +45,21 @@ func (n *Node) Info() map[string]interface{} {
 	}
 
 	m["node_ip"] = localip
-	m["friends_states"] = n.friends.states
-	m["friends_contacts"] = n.friends.contacts
+	n.friends.Lock()
+	states, contacts := map[string]repState{}, map[string]string{}
+	for k, v := range n.friends.states {
+		states[k] = *v
+	}
+	for k, v := range n.friends.contacts {
+		contacts[k] = v
+	}
+	m["friends_states"] = states
+	m["friends_contacts"] = contacts
+	filters := map[string]ReplicationFilter{}
+	for k, v := range n.friends.options {
+		filters[k] = v.Filter
+	}
+	m["friends_filters"] = filters
 
 	minCheckpoint := int64(1 << 62)
 	for _, r := range n.friends.states {
@@ -52,6 +69,64 @@ func (n *Node) Info() map[string]interface{} {
 	}
 
 	m["friends_min_checkpoint"] = minCheckpoint
+	n.friends.Unlock()
+	m["append_chain_limit"] = n.appendChainLimit
+	m["append_chains_compacted"] = atomic.LoadInt64(&n.compacted)
+	m["conflicts_detected"] = atomic.LoadInt64(&n.conflicts)
+
+	resolvers := map[string]string{}
+	for prefix, r := range n.resolvers.m {
+		resolvers[prefix] = r.Strategy
+	}
+	m["resolvers"] = resolvers
+
+	n.antiEntropy.Lock()
+	m["anti_entropy"] = map[string]interface{}{
+		"interval": n.antiEntropy.Interval.Seconds(),
+		"since":    n.repairSince(),
+		"results":  n.antiEntropy.results,
+	}
+	n.antiEntropy.Unlock()
+
+	n.retention.Lock()
+	m["retention"] = map[string]interface{}{
+		"keep_versions": n.retention.policy.KeepVersions,
+		"keep_duration": n.retention.policy.KeepDuration.Seconds(),
+		"last_run_at":   n.retention.LastRunAt,
+		"last_cost":     n.retention.LastCost,
+		"pruned":        n.retention.Pruned,
+		"folded":        n.retention.Folded,
+		"last_error":    n.retention.LastError,
+	}
+	m["tombstone_gc"] = map[string]interface{}{
+		"enabled":     n.retention.policy.TombstoneGrace > 0,
+		"grace":       n.retention.policy.TombstoneGrace.Seconds(),
+		"horizon":     n.retention.GCHorizon,
+		"last_run_at": n.retention.LastRunAt,
+		"purged":      n.retention.Tombstones,
+	}
+	n.retention.Unlock()
+
+	n.logTruncation.Lock()
+	m["log_truncation"] = map[string]interface{}{
+		"interval":    n.logTruncation.Interval.Seconds(),
+		"margin":      n.logTruncation.Margin.Seconds(),
+		"truncated":   n.log.Truncated(),
+		"horizon":     n.logTruncation.Horizon,
+		"last_run_at": n.logTruncation.LastRunAt,
+		"dropped":     n.logTruncation.Dropped,
+		"last_error":  n.logTruncation.LastError,
+	}
+	n.logTruncation.Unlock()
+
+	n.acl.RLock()
+	m["acl"] = map[string]interface{}{
+		"enabled":    n.acl.path != "",
+		"file":       n.acl.path,
+		"principals": len(n.acl.users),
+		"loaded_at":  n.acl.loadedAt,
+	}
+	n.acl.RUnlock()
 
 	return m
 }
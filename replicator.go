@@ -1,8 +1,10 @@
-package main
+package gouch
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -12,13 +14,20 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/gouch/clock"
-	"github.com/gogo/protobuf/proto"
+	"github.com/coyove/gouch/driver"
 )
 
-var httpClient = &http.Client{Timeout: time.Second}
+const (
+	replicationBatch = 100
+
+	// replicationWait is how long a /replicate request will be held by the peer when there are no changes
+	replicationWait    = 30 * time.Second
+	maxReplicationWait = time.Minute
+)
 
 type repState struct {
 	NodeName         string    `json:"node_name"`
@@ -31,16 +40,24 @@ type repState struct {
 
 	RevCheckpoint    int64 `json:"rev_checkpoint"`
 	RevCheckpointTmp int64 `json:"rev_checkpoint_tmp"`
+
+	stop   chan struct{}      // closed when the peer is removed
+	cancel context.CancelFunc // cancels the request in flight, see UpdatePeer
 }
 
 func (n *Node) readRepState(friends string) {
 	n.friends.contacts = map[string]string{}
+	n.friends.options = map[string]peerOptions{}
 	n.friends.states = map[string]*repState{}
 
 	flag := false
 	for _, f := range strings.Split(friends, ";") {
 		f = strings.TrimSpace(f)
-		if f == "" {
+		if f == "" || strings.HasPrefix(f, "resolver:") {
+			continue
+		}
+		if strings.HasPrefix(f, "secret:") {
+			n.clusterSecret = strings.TrimPrefix(f, "secret:")
 			continue
 		}
 		fu, err := url.Parse(f)
@@ -50,16 +67,23 @@ func (n *Node) readRepState(friends string) {
 		}
 		name := fu.User.String()
 		if name == n.Name {
+			n.secret = fu.Query().Get("secret")
 			flag = true
 			continue
 		}
 		n.friends.contacts[name] = fu.Scheme + "://" + fu.Host
+		n.friends.options[name] = parsePeerOptions(fu.Query())
 	}
 
 	if !flag {
 		log.Println("WARN: yourself (node:", n.Name, ") is not found in the friend list")
 	}
 
+	// Membership changed at runtime overrides the config
+	if err := n.readMembers(); err != nil {
+		log.Println("WARN: read members error:", err)
+	}
+
 	fn := filepath.Join(n.path, "replication")
 	if _, err := os.Stat(fn); os.IsNotExist(err) {
 		// Not exist, create
@@ -75,6 +99,11 @@ func (n *Node) readRepState(friends string) {
 		}
 	}
 
+	for k := range n.friends.states {
+		if n.friends.contacts[k] == "" {
+			delete(n.friends.states, k)
+		}
+	}
 	for k := range n.friends.contacts {
 		if n.friends.states[k] == nil {
 			n.friends.states[k] = &repState{
@@ -97,60 +126,148 @@ func (n *Node) writeRepState(name string) {
 	}
 }
 
+// replicationWorker pulls from the peer until it is removed or the node is closed,
+// it is registered in n.jobs by the caller, so Close waits for it
 func (n *Node) replicationWorker(f *repState) {
+	defer n.jobs.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-n.closed:
+		case <-f.stop:
+		}
+		cancel()
+	}()
+
 	for {
-		resp, err := httpClient.Get(n.friends.contacts[f.NodeName] +
-			"/replicate?ver=" + strconv.FormatInt(f.Checkpoint, 10) +
-			"&me=" + n.Name)
+		req, cancelReq := context.WithCancel(ctx)
+		n.friends.Lock()
+		f.cancel = cancelReq
+		n.friends.Unlock()
+
+		err := n.replicateOnce(req, f)
+		updated := req.Err() != nil
+		cancelReq()
+		if ctx.Err() != nil {
+			return
+		}
+		if updated {
+			continue // The peer has been updated, retry with its new address
+		}
 		if err != nil {
-			f.LastError = err.Error() + "/" + time.Now().String()
-		} else {
-			buf, _ := ioutil.ReadAll(resp.Body)
-			resp.Body.Close()
-
-			p := &Pairs{}
-			if err := proto.Unmarshal(buf, p); err != nil {
-				f.LastError = err.Error() + "/" + resp.Header.Get("X-Msg")
-			} else {
-				if err := n.PutKeyParis(p.Data); err != nil {
-					f.LastError = err.Error()
-				} else {
-					if p.Next > f.Checkpoint {
-						f.Checkpoint = p.Next
-						f.Progress = float64(f.Checkpoint-n.log.Genesis()) / float64(clock.Timestamp()-n.log.Genesis())
-					} else {
-						f.Progress = 1
-					}
-					if p.NodeInternalName != "" {
-						f.NodeInternalName = p.NodeInternalName
-					}
-					f.LastError = ""
-					f.LastJobAt = time.Now()
-					f.LastJobTimestamp = clock.Timestamp()
-					n.writeRepState(f.NodeName)
-				}
+			n.friends.Lock()
+			f.LastError = err.Error()
+			n.friends.Unlock()
+		}
+
+		// The peer holds the request until there are changes, or returns immediately if
+		// the batch was full, so we can loop immediately unless something went wrong
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
 			}
 		}
-		time.Sleep(time.Second)
 	}
 }
 
+// replicateOnce pulls one batch of changes from the peer
+func (n *Node) replicateOnce(ctx context.Context, f *repState) error {
+	n.friends.Lock()
+	addr, filter := n.friends.contacts[f.NodeName], n.friends.options[f.NodeName].Filter
+	checkpoint := f.Checkpoint
+	n.friends.Unlock()
+
+	q := filter.values()
+	q.Set("ver", strconv.FormatInt(checkpoint, 10))
+	q.Set("n", strconv.Itoa(replicationBatch))
+	q.Set("wait", replicationWait.String())
+	req, err := http.NewRequest("GET", n.signedURL("GET", addr+"/replicate", q, nil), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%v/%v", err, time.Now())
+	}
+
+	p, err := readPairs(resp)
+	if err != nil {
+		return err
+	}
+
+	if err := n.PutKeyParis(p.Data); err != nil {
+		return err
+	}
+
+	genesis := n.log.Genesis()
+	n.friends.Lock()
+	if p.Next > f.Checkpoint {
+		f.Checkpoint = p.Next
+		f.Progress = float64(f.Checkpoint-genesis) / float64(clock.Timestamp()-genesis)
+	} else {
+		f.Progress = 1
+	}
+	if p.NodeInternalName != "" {
+		f.NodeInternalName = p.NodeInternalName
+	}
+	f.LastError = ""
+	f.LastJobAt = time.Now()
+	f.LastJobTimestamp = clock.Timestamp()
+	n.friends.Unlock()
+	n.writeRepState(f.NodeName)
+	return nil
+}
+
+// GetChangedKeysSince returns pairs logged since startTimestamp, including those replicated from other peers,
+// so writes can flow through multiple hops. Res.Next is the timestamp the next call should start from.
 func (n *Node) GetChangedKeysSince(startTimestamp int64, count int) (*Pairs, error) {
+	return n.GetFilteredKeysSince(startTimestamp, count, ReplicationFilter{})
+}
+
+// GetFilteredKeysSince is GetChangedKeysSince with keys not matching the filter skipped,
+// Res.Next still advances past them, so the caller will not see them again
+func (n *Node) GetFilteredKeysSince(startTimestamp int64, count int, filter ReplicationFilter) (*Pairs, error) {
 	c, err := n.log.GetCursor(startTimestamp)
 	if err != nil {
 		return nil, err
 	}
 	defer c.Close()
 
+	// Checked after the cursor is opened, so truncations in between will not be missed
+	if startTimestamp < n.log.Truncated() {
+		return nil, ErrCheckpointTooOld
+	}
+
 	res := &Pairs{NodeInternalName: n.InternalName()}
+	last := int64(-1)
 
-	for !c.End() && len(res.Data) < count {
+	// Limit records scanned, in case most of them are filtered out
+	for scanned := 0; !c.End() && (len(res.Data) < count || c.Linked()) &&
+		(scanned < count*100 || c.Linked()); scanned++ {
 		ts, key, err := c.Data()
 		if err != nil {
 			return nil, err
 		}
+		last = ts
+
+		// Replicated writes are logged with their full db keys, local writes with user keys
+		dbkey := key
+		if idx := bytes.IndexByte(key, 0); idx == -1 {
+			dbkey = n.combineKeyVer(string(key), ts)
+		} else {
+			key = key[:idx]
+		}
+
+		if !filter.match(string(key)) {
+			if !c.Next() {
+				break
+			}
+			continue
+		}
 
-		dbkey := n.combineKeyVer(string(key), ts)
 		k, v, err := n.db.Get(dbkey)
 		if err != nil {
 			return nil, err
@@ -165,20 +282,84 @@ func (n *Node) GetChangedKeysSince(startTimestamp int64, count int) (*Pairs, err
 		}
 	}
 
-	if len(res.Data) > 0 {
-		res.Next = versionInKey(res.Data[len(res.Data)-1].Key) + 1
+	if last >= 0 {
+		res.Next = last + 1
 	}
 
 	return res, nil
 }
 
+// PutKeyParis writes pairs replicated from a peer, pairs already present or written by us will be skipped.
+// Written pairs are logged as well, so they can be served to other peers
 func (n *Node) PutKeyParis(pairs []Pair) error {
 	sort.Slice(pairs, func(i, j int) bool {
 		return bytes.Compare(pairs[i].Key, pairs[j].Key) == -1
 	})
-	kvs := [][]byte{}
-	for _, p := range pairs {
-		kvs = append(kvs, p.Key, p.Value)
+
+	// Workers of different peers may receive the same pairs at the same time
+	n.replicating.Lock()
+	defer n.replicating.Unlock()
+
+	keys, kvs := [][]byte{}, [][]byte{}
+	if err := n.db.View(func(r driver.Reader) error {
+		for _, p := range pairs {
+			idx := bytes.IndexByte(p.Key, 0)
+			if idx == -1 || len(p.Key[idx:]) != 16 {
+				return fmt.Errorf("invalid replicated key: %q", p.Key)
+			}
+			if bytes.Equal(p.Key[idx+8:], n.internalName) {
+				continue
+			}
+			k, _, err := r.Get(p.Key)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(k, p.Key) {
+				continue
+			}
+			keys = append(keys, p.Key)
+			kvs = append(kvs, p.Key, p.Value)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if _, err := n.log.Append(keys, func([]int64) error {
+		return n.db.Put(kvs...)
+	}); err != nil {
+		return err
+	}
+	n.foldLateAppends(keys)
+
+	// Concurrent writes are kept as siblings and resolved when reading,
+	// merge and priority resolvers resolve them here as well, see resolveReplicated
+	resolved := map[string]bool{}
+	for _, k := range keys {
+		key := string(k[:bytes.IndexByte(k, 0)])
+		res := n.resolvers.match(key)
+		if res == nil || resolved[key] {
+			continue
+		}
+		resolved[key] = true
+
+		sibs, err := n.GetSiblings(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(sibs) > 1 {
+			atomic.AddInt64(&n.conflicts, 1)
+			if err := n.resolveReplicated(key, res, sibs); err != nil {
+				return err
+			}
+		}
 	}
-	return n.db.Put(kvs...)
+	return nil
 }
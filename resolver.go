@@ -0,0 +1,214 @@
+package gouch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coyove/gouch/driver"
+)
+
+const (
+	ResolveLWW      = "lww"      // the latest version wins (default)
+	ResolvePriority = "priority" // the sibling written by the node listed first in Priority wins
+	ResolveSiblings = "siblings" // the latest sibling is returned along with all siblings
+	ResolveMerge    = "merge"    // siblings are merged by Merge, from the oldest to the latest
+)
+
+// MergeFunc merges two sibling values, a is older than b
+type MergeFunc func(a, b []byte) []byte
+
+// Resolver resolves siblings (see PutContext) of keys when reading
+type Resolver struct {
+	Strategy string
+	Priority []string // node names, highest priority first
+	Merge    MergeFunc
+}
+
+type resolverRegistry struct {
+	prefixes []string // sorted by length, longest first
+	m        map[string]Resolver
+}
+
+// parseResolver parses 'resolver:prefix=strategy[:args]' entries in nodes.config, e.g.:
+// 'resolver:users/=priority:node1,node2' or 'resolver:docs/=merge:json',
+// where json must be provided in Options.MergeFuncs
+func parseResolver(entry string, mergeFuncs map[string]MergeFunc) (string, Resolver, error) {
+	entry = strings.TrimPrefix(entry, "resolver:")
+	idx := strings.LastIndex(entry, "=")
+	if idx == -1 {
+		return "", Resolver{}, fmt.Errorf("invalid resolver: %q", entry)
+	}
+
+	prefix, strategy := entry[:idx], entry[idx+1:]
+	args := ""
+	if idx := strings.Index(strategy, ":"); idx > -1 {
+		strategy, args = strategy[:idx], strategy[idx+1:]
+	}
+
+	res := Resolver{Strategy: strategy}
+	switch strategy {
+	case ResolveLWW, ResolveSiblings:
+	case ResolvePriority:
+		res.Priority = strings.Split(args, ",")
+	case ResolveMerge:
+		if res.Merge = mergeFuncs[args]; res.Merge == nil {
+			return "", Resolver{}, fmt.Errorf("merge func %q not found", args)
+		}
+	default:
+		return "", Resolver{}, fmt.Errorf("unknown strategy: %q", strategy)
+	}
+	return prefix, res, nil
+}
+
+func (reg *resolverRegistry) add(prefix string, r Resolver) error {
+	if r.Strategy == "" {
+		r.Strategy = ResolveLWW
+	}
+	if r.Strategy == ResolveMerge && r.Merge == nil {
+		return fmt.Errorf("resolver %q: nil merge func", prefix)
+	}
+
+	if reg.m == nil {
+		reg.m = map[string]Resolver{}
+	}
+	if _, ok := reg.m[prefix]; !ok {
+		reg.prefixes = append(reg.prefixes, prefix)
+		sort.Slice(reg.prefixes, func(i, j int) bool {
+			return len(reg.prefixes[i]) > len(reg.prefixes[j])
+		})
+	}
+	reg.m[prefix] = r
+	return nil
+}
+
+// match returns the resolver of the longest prefix matching the key, or nil if it is LWW
+func (reg *resolverRegistry) match(key string) *Resolver {
+	for _, p := range reg.prefixes {
+		if strings.HasPrefix(key, p) {
+			if r := reg.m[p]; r.Strategy != ResolveLWW {
+				return &r
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// getResolved returns the value of the key at version asOf, resolved by the matching resolver
+func (n *Node) getResolved(r driver.Reader, key string, asOf int64) (Entry, error) {
+	res := n.resolvers.match(key)
+	if res == nil {
+		k, v, err := n.getcas(r, n.upperKeyVer(key, asOf), 0)
+		if err != nil {
+			return Entry{}, err
+		}
+		return createEntry(k, v, false), nil
+	}
+
+	sibs, err := n.siblings(r, key, asOf)
+	if err != nil {
+		return Entry{}, err
+	}
+	return n.resolve(res, sibs)
+}
+
+// resolve resolves siblings (the latest first) into one entry
+func (n *Node) resolve(res *Resolver, sibs []Entry) (Entry, error) {
+	live := make([]Entry, 0, len(sibs))
+	for _, s := range sibs {
+		if !s.Deleted {
+			live = append(live, s)
+		}
+	}
+
+	switch res.Strategy {
+	case ResolvePriority:
+		best, bestp := -1, len(res.Priority)
+		for i, s := range sibs {
+			name := n.Whois(s.Node)
+			if s.Node == n.InternalName() {
+				name = n.Name
+			}
+			p := len(res.Priority)
+			for j, pn := range res.Priority {
+				if pn == name {
+					p = j
+					break
+				}
+			}
+			if best == -1 || p < bestp {
+				best, bestp = i, p
+			}
+		}
+		if best == -1 || sibs[best].Deleted {
+			return Entry{}, ErrNotFound
+		}
+		return sibs[best], nil
+	case ResolveSiblings:
+		if len(live) == 0 {
+			return Entry{}, ErrNotFound
+		}
+		e := live[0]
+		if len(sibs) > 1 {
+			e.Siblings = sibs
+		}
+		return e, nil
+	case ResolveMerge:
+		if len(live) == 0 {
+			return Entry{}, ErrNotFound
+		}
+		// Siblings with the same values, e.g. resolved by different peers, are merged once
+		v := []byte(live[len(live)-1].Value)
+		merged := map[string]bool{live[len(live)-1].Value: true}
+		for i := len(live) - 2; i >= 0; i-- {
+			if !merged[live[i].Value] {
+				merged[live[i].Value] = true
+				v = res.Merge(v, []byte(live[i].Value))
+			}
+		}
+		e := live[0]
+		e.Value, e.ValueLen = string(v), int64(len(v))
+		return e, nil
+	default:
+		if len(sibs) == 0 || sibs[0].Deleted {
+			return Entry{}, ErrNotFound
+		}
+		return sibs[0], nil
+	}
+}
+
+// resolveReplicated writes the value resolved from siblings of the key, if they are created by replicated
+// versions and the resolver can resolve them without readers (ResolveMerge and ResolvePriority).
+// The written version supersedes all siblings and is replicated to peers. Siblings with the same values
+// are not resolved, so peers resolving the same siblings will not resolve each other's results again
+func (n *Node) resolveReplicated(key string, res *Resolver, sibs []Entry) error {
+	if res.Strategy != ResolveMerge && res.Strategy != ResolvePriority {
+		return nil
+	}
+
+	distinct := false
+	for _, s := range sibs[1:] {
+		if s.Deleted != sibs[0].Deleted || s.Value != sibs[0].Value {
+			distinct = true
+			break
+		}
+	}
+	if !distinct {
+		return nil
+	}
+
+	v := deletionUUID
+	e, err := n.resolve(res, sibs)
+	if err == nil {
+		v = []byte(e.Value)
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	// New siblings written in between will be resolved later
+	if _, err := n.Resolve(key, v, sibs[0].Ver); err != nil && err != ErrConflict {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package gouch
+
+import (
+	"testing"
+)
+
+func TestResolvers(t *testing.T) {
+	merge := func(a, b []byte) []byte { return append(append(a, '+'), b...) }
+	opts := func(name string) Options {
+		return Options{
+			Driver:     "memory",
+			Name:       name,
+			Peers:      "http://a@127.0.0.1:1;http://b@127.0.0.1:1;resolver:p/=priority:b,a;resolver:s/=siblings;resolver:m/=merge:plus;resolver:m/lww/=lww",
+			MergeFuncs: map[string]MergeFunc{"plus": merge},
+		}
+	}
+	a := testNode(t, opts("a"))
+	defer closeTestNode(a)
+	b := testNode(t, opts("b"))
+	defer closeTestNode(b)
+
+	pull := func(to, from *Node) {
+		p, err := from.GetChangedKeysSince(0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := to.PutKeyParis(p.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := []string{"p/x", "s/x", "m/x", "m/lww/x"}
+	for _, k := range keys {
+		b.PutContext(k, []byte("b"), 0)
+	}
+	pull(a, b)
+	a.friends.Lock()
+	a.friends.states["b"].NodeInternalName = b.InternalName()
+	a.friends.Unlock()
+	for _, k := range keys {
+		a.PutContext(k, []byte("a"), 0)
+	}
+
+	expect := map[string]string{"p/x": "b", "s/x": "a", "m/x": "b+a", "m/lww/x": "a"}
+	for k, v := range expect {
+		if e, err := a.Get(k); err != nil || e.Value != v {
+			t.Fatal(k, e, err)
+		}
+	}
+	if e, _ := a.Get("s/x"); len(e.Siblings) != 2 {
+		t.Fatal(e)
+	}
+
+	res, _, err := a.Range("", "", 10, false, false, false)
+	if err != nil || len(res) != 4 {
+		t.Fatal(res, err)
+	}
+	for _, e := range res {
+		if e.Value != expect[e.Key] {
+			t.Fatal(e)
+		}
+	}
+
+	pull(b, a)
+	if b.conflicts != 3 {
+		t.Fatal(b.conflicts)
+	}
+	if e, err := b.Get("m/x"); err != nil || e.Value != "b+a" {
+		t.Fatal(e, err)
+	}
+
+	// Merge and priority siblings are resolved when replicated, others are kept
+	for k, c := range map[string]int{"p/x": 1, "m/x": 1, "s/x": 2} {
+		if sibs, err := b.GetSiblings(k); err != nil || len(sibs) != c {
+			t.Fatal(k, sibs, err)
+		}
+	}
+	pull(a, b)
+	for k, v := range expect {
+		if e, err := a.Get(k); err != nil || e.Value != v {
+			t.Fatal(k, e, err)
+		}
+	}
+	if sibs, _ := a.GetSiblings("m/x"); len(sibs) != 1 || a.conflicts != 0 {
+		t.Fatal(sibs, a.conflicts)
+	}
+}
@@ -0,0 +1,295 @@
+package gouch
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coyove/gouch/clock"
+	"github.com/coyove/gouch/driver"
+)
+
+// RetentionPolicy controls how old versions are pruned, the latest version of a key is always kept
+type RetentionPolicy struct {
+	// KeepVersions keeps at most N versions per key, 0 means unlimited
+	KeepVersions int
+
+	// KeepDuration drops versions older than it, 0 means forever
+	KeepDuration time.Duration
+
+	// TombstoneGrace enables the tombstone GC: once all peers have replicated a tombstone and
+	// the grace period has elapsed, the tombstone and all older versions of the key will be purged.
+	// Without replication keys or ACL, anyone can claim to be a peer which has replicated everything
+	TombstoneGrace time.Duration
+
+	// Interval is the interval between two background runs, default 10 minutes
+	Interval time.Duration
+
+	// BatchSize is the number of versions scanned before pruning them, default 1000
+	BatchSize int
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.KeepVersions > 0 || p.KeepDuration > 0 || p.TombstoneGrace > 0
+}
+
+type retentionState struct {
+	sync.Mutex
+	snapshots  sync.RWMutex // held by snapshots being written, pruning waits for them, see WriteSnapshot
+	policy     RetentionPolicy
+	running    bool
+	LastRunAt  time.Time
+	LastCost   float64
+	Pruned     int64
+	Folded     int64
+	Tombstones int64
+	GCHorizon  int64
+	LastError  string
+}
+
+type versionInfo struct {
+	key       []byte
+	ver       int64
+	appended  bool
+	deleted   bool
+	compacted bool
+}
+
+func (n *Node) retentionWorker() {
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-time.After(n.retention.policy.Interval):
+		}
+
+		if _, err := n.PruneHistory(); err != nil {
+			log.Println("WARN: prune history error:", err)
+		}
+	}
+}
+
+// PruneHistory walks all keys and deletes versions not retained by the policy,
+// it returns the number of versions deleted
+func (n *Node) PruneHistory() (int, error) {
+	rs := &n.retention
+	rs.Lock()
+	if rs.running {
+		rs.Unlock()
+		return 0, nil
+	}
+	rs.running = true
+	rs.Unlock()
+
+	if !n.track() {
+		rs.Lock()
+		rs.running = false
+		rs.Unlock()
+		return 0, ErrClosed
+	}
+	defer n.jobs.Done()
+
+	start := time.Now()
+	horizon := n.gcHorizon()
+	rs.snapshots.Lock()
+	pruned, folded, tombstones, err := n.pruneHistory(rs.policy, horizon)
+	rs.snapshots.Unlock()
+
+	rs.Lock()
+	defer rs.Unlock()
+	rs.running = false
+	rs.LastRunAt = start
+	rs.LastCost = time.Since(start).Seconds()
+	rs.Pruned += int64(pruned)
+	rs.Folded += int64(folded)
+	rs.Tombstones += int64(tombstones)
+	rs.GCHorizon = horizon
+	rs.LastError = ""
+	if err != nil {
+		rs.LastError = err.Error()
+	}
+	return pruned, err
+}
+
+// gcHorizon returns the minimal checkpoint of all peers pulling from us,
+// versions before it have been replicated by everyone. It is 0 if there are no peers
+func (n *Node) gcHorizon() int64 {
+	n.friends.Lock()
+	defer n.friends.Unlock()
+
+	if len(n.friends.contacts) == 0 {
+		return 0
+	}
+	h := clock.Timestamp()
+	for name := range n.friends.contacts {
+		if f := n.friends.states[name]; f == nil {
+			return 0
+		} else if f.RevCheckpoint < h {
+			h = f.RevCheckpoint
+		}
+	}
+	return h
+}
+
+func (n *Node) pruneHistory(p RetentionPolicy, horizon int64) (pruned, folded, tombstones int, err error) {
+	if !p.enabled() {
+		return
+	}
+	if p.BatchSize <= 0 {
+		p.BatchSize = 1000
+	}
+
+	var (
+		next      = []byte{}
+		now       = clock.Timestamp()
+		oldest    = int64(0)
+		tombstone = int64(0)
+	)
+	if p.KeepDuration > 0 {
+		oldest = now - int64(p.KeepDuration/time.Second)<<20
+	}
+	n.friends.Lock()
+	peers := len(n.friends.contacts) > 0
+	n.friends.Unlock()
+
+	// Without peers, no one needs tombstones
+	var unreplicated map[string]bool
+	if p.TombstoneGrace > 0 && (horizon > 0 || !peers) {
+		tombstone = now - int64(p.TombstoneGrace/time.Second)<<20
+		if peers {
+			if unreplicated, err = n.loggedSince(horizon); err != nil {
+				return
+			}
+		}
+	}
+
+	for next != nil {
+		var keys [][]versionInfo
+		keys, next, err = n.scanVersions(next, p.BatchSize)
+		if err != nil {
+			return
+		}
+
+		for _, vers := range keys {
+			pn, fn, tn, err := n.pruneVersions(vers, p.KeepVersions, oldest, tombstone, unreplicated, now)
+			pruned, folded, tombstones = pruned+pn, folded+fn, tombstones+tn
+			if err != nil {
+				return pruned, folded, tombstones, err
+			}
+		}
+	}
+	return
+}
+
+// scanVersions returns versions grouped by keys starting from start, a key will never be split
+// across two calls. The returned next is where the next scan should start, or nil if ended
+func (n *Node) scanVersions(start []byte, batchSize int) (keys [][]versionInfo, next []byte, err error) {
+	count := 0
+	err = n.db.Seek(start, func(k, v []byte) int {
+		if bytes.Equal(k, internalNodeName) {
+			return driver.SeekNext
+		}
+
+		v, _ = splitContext(v)
+		vi := versionInfo{
+			key:      append([]byte{}, k...),
+			ver:      versionInKey(k),
+			appended: bytes.HasPrefix(v, appendUUID),
+			deleted:  bytes.Equal(v, deletionUUID),
+		}
+		_, vi.compacted = splitCompacted(v)
+
+		if len(keys) > 0 && hasCommonPrefixTill0(keys[len(keys)-1][0].key, k) {
+			keys[len(keys)-1] = append(keys[len(keys)-1], vi)
+		} else {
+			if count >= batchSize {
+				next = vi.key
+				return driver.SeekAbort
+			}
+			keys = append(keys, []versionInfo{vi})
+		}
+		count++
+		return driver.SeekNext
+	})
+	return
+}
+
+// loggedSince returns db keys of all versions logged at or after the timestamp. Versions replicated
+// from peers are logged when received, so their versions can't tell whether peers have pulled them
+func (n *Node) loggedSince(since int64) (map[string]bool, error) {
+	c, err := n.log.GetCursor(since)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	res := map[string]bool{}
+	for ; !c.End(); c.Next() {
+		ts, key, err := c.Data()
+		if err != nil {
+			return nil, err
+		}
+		if ts < since {
+			continue
+		}
+		if bytes.IndexByte(key, 0) == -1 {
+			key = n.combineKeyVer(string(key), ts)
+		}
+		res[string(key)] = true
+	}
+	return res, nil
+}
+
+// pruneVersions prunes versions of one key (in ascending order), if the oldest retained version
+// is appended, it will be folded into a full value first, so reading the key still gives the same result
+// If the latest version is a tombstone before tombstoneBefore and not in unreplicated, all versions will be purged
+func (n *Node) pruneVersions(vers []versionInfo, keepVersions int, oldest, tombstoneBefore int64, unreplicated map[string]bool, now int64) (pruned, folded, tombstones int, err error) {
+	// Future versions are not considered
+	for len(vers) > 0 && vers[len(vers)-1].ver > now {
+		vers = vers[:len(vers)-1]
+	}
+	if len(vers) == 0 {
+		return
+	}
+
+	drop := 0 // versions before drop will be deleted
+	if latest := vers[len(vers)-1]; latest.deleted && latest.ver < tombstoneBefore && !unreplicated[string(latest.key)] {
+		drop, tombstones = len(vers), 1
+	} else {
+		if keepVersions > 0 && len(vers) > keepVersions {
+			drop = len(vers) - keepVersions
+		}
+		for drop < len(vers)-1 && vers[drop].ver < oldest {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return
+	}
+
+	// Compactions are folded as well, otherwise late appends would walk through them
+	// into versions which are gone, see foldLateAppends
+	if drop < len(vers) && (vers[drop].appended || vers[drop].compacted) {
+		base := vers[drop]
+		k, v, err := n.getcas(n.db, base.key, 0)
+		if err != nil && err != ErrNotFound {
+			return 0, 0, 0, err
+		}
+		if err == nil && bytes.Equal(k, base.key) {
+			if err := n.db.Put(base.key, v); err != nil {
+				return 0, 0, 0, err
+			}
+			folded++
+		}
+	}
+
+	keys := make([][]byte, drop)
+	for i := range keys {
+		keys[i] = vers[i].key
+	}
+	if err := n.Purge(keys...); err != nil {
+		return 0, folded, 0, err
+	}
+	return drop, folded, tombstones, nil
+}
@@ -0,0 +1,125 @@
+package gouch
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coyove/gouch/clock"
+)
+
+func TestPruneHistory(t *testing.T) {
+	n := testNode(t, Options{Driver: "memory", Retention: RetentionPolicy{KeepVersions: 2, BatchSize: 2}})
+	defer os.RemoveAll(n.path)
+
+	n.Put("a", []byte("1"), false)
+	for _, v := range []string{"2", "3", "4"} {
+		n.Put("a", []byte(v), true)
+	}
+	n.Put("b", []byte("1"), false)
+	n.Put("c", []byte("1"), false)
+	n.Delete("c")
+	for i := 0; i < 5; i++ {
+		n.Put("d", []byte{'0' + byte(i)}, false)
+	}
+
+	pruned, err := n.PruneHistory()
+	if err != nil || pruned != 5 {
+		t.Fatal(pruned, err)
+	}
+	if n.retention.Folded != 1 {
+		t.Fatal(n.retention.Folded)
+	}
+
+	for k, v := range map[string]string{"a": "1234", "b": "1", "d": "4"} {
+		if e, err := n.Get(k); err != nil || e.Value != v {
+			t.Fatal(k, e, err)
+		}
+	}
+	if _, err := n.Get("c"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+
+	for k, c := range map[string]int{"a": 2, "b": 1, "c": 2, "d": 2} {
+		if vers, _, _ := n.GetAllVersions(k, 0, 10, false); len(vers) != c {
+			t.Fatal(k, vers)
+		}
+	}
+
+	if pruned, _ := n.PruneHistory(); pruned != 0 {
+		t.Fatal(pruned)
+	}
+
+	n.Close()
+	if _, err := n.PruneHistory(); err != ErrClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestTombstoneGC(t *testing.T) {
+	n := testNode(t, Options{
+		Driver:    "memory",
+		Peers:     "http://test@127.0.0.1:1;http://peer@127.0.0.1:1",
+		Retention: RetentionPolicy{TombstoneGrace: time.Nanosecond},
+	})
+	defer closeTestNode(n)
+
+	n.Put("a", []byte("1"), false)
+	n.Put("a", []byte("2"), false)
+	n.Delete("a")
+	n.Put("b", []byte("1"), false)
+	time.Sleep(time.Second)
+
+	// Peer hasn't replicated anything yet
+	if pruned, err := n.PruneHistory(); err != nil || pruned != 0 {
+		t.Fatal(pruned, err)
+	}
+
+	n.friends.Lock()
+	n.friends.states["peer"].RevCheckpoint = clock.Timestamp()
+	n.friends.Unlock()
+
+	if pruned, err := n.PruneHistory(); err != nil || pruned != 3 {
+		t.Fatal(pruned, err)
+	}
+	if n.retention.Tombstones != 1 || n.retention.GCHorizon == 0 {
+		t.Fatal(n.retention.Tombstones, n.retention.GCHorizon)
+	}
+	if vers, _, _ := n.GetAllVersions("a", 0, 10, true); len(vers) != 0 {
+		t.Fatal(vers)
+	}
+	if e, err := n.Get("b"); err != nil || e.Value != "1" {
+		t.Fatal(e, err)
+	}
+
+	// Tombstones replicated from other nodes carry older versions, but are logged when received
+	x := testNode(t, Options{Driver: "memory", Name: "x"})
+	defer closeTestNode(x)
+	x.Put("c", []byte("1"), false)
+	x.Delete("c")
+	p, _ := x.GetChangedKeysSince(0, 10)
+
+	n.friends.Lock()
+	n.friends.states["peer"].RevCheckpoint = clock.Timestamp()
+	n.friends.Unlock()
+	if err := n.PutKeyParis(p.Data); err != nil {
+		t.Fatal(err)
+	}
+	if pruned, err := n.PruneHistory(); err != nil || pruned != 0 {
+		t.Fatal(pruned, err)
+	}
+
+	n.friends.Lock()
+	n.friends.states["peer"].RevCheckpoint = clock.Timestamp()
+	n.friends.Unlock()
+	if pruned, err := n.PruneHistory(); err != nil || pruned != 2 {
+		t.Fatal(pruned, err)
+	}
+
+	// Without peers, tombstones are purged after the grace
+	x.retention.policy = RetentionPolicy{TombstoneGrace: time.Nanosecond}
+	time.Sleep(time.Second)
+	if pruned, err := x.PruneHistory(); err != nil || pruned != 2 {
+		t.Fatal(pruned, err)
+	}
+}
@@ -0,0 +1,128 @@
+package gouch
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// signatureWindow is the maximum difference between the signing time and now, to limit replays
+const signatureWindow = 5 * time.Minute
+
+// signature signs the method, the path, all params except 'sig' (sorted by url.Values.Encode) and the body hash
+func signature(key, method, path string, q url.Values, body []byte) string {
+	params := url.Values{}
+	for k, v := range q {
+		if k != "sig" {
+			params[k] = v
+		}
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(h, "%s\n%s\n%s\n%x", method, path, params.Encode(), sha256.Sum256(body))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signedURL returns u with params q signed, see signRequest
+func (n *Node) signedURL(method, u string, q url.Values, body []byte) string {
+	return u + "?" + n.signRequest(method, u, q, body).Encode()
+}
+
+// signRequest sets 'me' of the request to peers at u, and signs it with the key of this node
+// ('secret' param of its own entry in nodes.config), or the cluster key ('secret:<key>' entry).
+// The signature covers the method, the path, all params including the signing time 'ts' and the body
+func (n *Node) signRequest(method, u string, q url.Values, body []byte) url.Values {
+	q.Set("me", n.Name)
+
+	key := n.secret
+	if key == "" {
+		key = n.clusterSecret
+	}
+	if key == "" {
+		return q
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	q.Set("ts", ts)
+	path := u
+	if pu, err := url.Parse(u); err == nil {
+		path = pu.Path
+	}
+	q.Set("sig", signature(key, method, path, q, body))
+	return q
+}
+
+// signing returns whether any key is configured, if so, requests from peers must be signed
+func (n *Node) signing() bool {
+	if n.secret != "" || n.clusterSecret != "" {
+		return true
+	}
+	n.friends.Lock()
+	defer n.friends.Unlock()
+	for _, o := range n.friends.options {
+		if o.secret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRequest verifies the signature of the request from a peer with the key of the peer
+// ('secret' param of its entry in nodes.config), or the cluster key
+func (n *Node) verifyRequest(r *http.Request) error {
+	if !n.signing() {
+		return nil
+	}
+
+	q := r.URL.Query()
+	me := q.Get("me")
+	n.friends.Lock()
+	key := n.friends.options[me].secret
+	n.friends.Unlock()
+	if key == "" {
+		key = n.clusterSecret
+	}
+	if key == "" || me == "" {
+		return fmt.Errorf("unknown peer: %q", me)
+	}
+
+	sig, ts := q.Get("sig"), q.Get("ts")
+	if sig == "" {
+		return fmt.Errorf("unsigned request")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid signing time")
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > signatureWindow || d < -signatureWindow {
+		return fmt.Errorf("signature expired")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := signature(key, r.Method, r.URL.Path, q, body)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// rejectPeer rejects unauthorized requests from peers, X-Error is set for protobuf clients
+func rejectPeer(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Add("X-Error", "true")
+	w.Header().Add("X-Msg", err.Error())
+	writeJSONCode(w, r, http.StatusUnauthorized, "error", true, "msg", err.Error())
+}
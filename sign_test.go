@@ -0,0 +1,84 @@
+package gouch
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestSignedReplication(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	peers := "http://a@" + srv.Listener.Addr().String() + "?secret=ka;http://b@127.0.0.1:1?secret=kb"
+	a := testNode(t, Options{Driver: "memory", Name: "a", Peers: peers, Mux: mux})
+	defer closeTestNode(a)
+	a.Put("k", []byte("v"), false)
+
+	b := testNode(t, Options{Driver: "memory", Name: "b", Peers: peers})
+	defer closeTestNode(b)
+	for i := 0; ; i++ {
+		if e, err := b.Get("k"); err == nil && e.Value == "v" {
+			break
+		}
+		if i > 100 {
+			t.Fatal("not replicated")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	do := func(method, path string, q url.Values, body ...byte) int {
+		req, _ := http.NewRequest(method, srv.URL+path+"?"+q.Encode(), bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	get := func(q url.Values) int { return do("GET", "/replicate", q) }
+
+	if code := get(url.Values{"me": {"b"}}); code != http.StatusUnauthorized {
+		t.Fatal("unsigned request:", code)
+	}
+	q := b.signRequest("GET", srv.URL+"/replicate", url.Values{"ver": {"0"}, "include": {"k"}}, nil)
+	if code := get(q); code != http.StatusOK {
+		t.Fatal("signed request:", code)
+	}
+	if code := do("POST", "/antientropy/pairs", q); code != http.StatusUnauthorized {
+		t.Fatal("replayed to another endpoint:", code)
+	}
+	q.Set("include", "")
+	if code := get(q); code != http.StatusUnauthorized {
+		t.Fatal("rewritten filter:", code)
+	}
+	q.Del("include")
+	q.Set("ver", "1")
+	if code := get(q); code != http.StatusUnauthorized {
+		t.Fatal("tampered request:", code)
+	}
+
+	// The body is signed as well
+	buf, _ := proto.Marshal(&Pairs{Data: []Pair{{Key: a.combineKeyVer("k", 1)}}})
+	q = b.signRequest("POST", srv.URL+"/antientropy/pairs", url.Values{}, buf)
+	if code := do("POST", "/antientropy/pairs", q, buf...); code != http.StatusOK {
+		t.Fatal("signed body:", code)
+	}
+	if code := do("POST", "/antientropy/pairs", q, append(buf, 0)...); code != http.StatusUnauthorized {
+		t.Fatal("tampered body:", code)
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	q = url.Values{"me": {"b"}, "ts": {ts}}
+	q.Set("sig", signature("wrong", "GET", "/replicate", q, nil))
+	if code := get(q); code != http.StatusUnauthorized {
+		t.Fatal("wrong key:", code)
+	}
+}
@@ -0,0 +1,163 @@
+package gouch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coyove/gouch/driver"
+	"github.com/gogo/protobuf/proto"
+)
+
+const snapshotChunk = 1000
+
+// SnapshotCheckpoints returns checkpoints matching a snapshot taken after it: the checkpoint of this node itself
+// and its checkpoints with every peer, a node seeded by the snapshot can replicate from them onwards
+func (n *Node) SnapshotCheckpoints() map[string]int64 {
+	n.friends.Lock()
+	cps := make(map[string]int64, len(n.friends.states)+1)
+	for name, f := range n.friends.states {
+		cps[name] = f.Checkpoint
+	}
+	n.friends.Unlock()
+
+	cps[n.Name] = n.log.Barrier()
+	return cps
+}
+
+// WriteSnapshot writes all versions to w, as a stream of uvarint length prefixed Pairs, ended with an empty chunk.
+// Versions are read chunk by chunk so writes are not blocked, thus it is not a point-in-time copy. But history
+// pruning, the only thing that deletes or rewrites versions besides Purge, waits for the transfer, so versions
+// are only added meanwhile and all versions present when SnapshotCheckpoints was called are in the snapshot
+func (n *Node) WriteSnapshot(w io.Writer) error {
+	n.retention.snapshots.RLock()
+	defer n.retention.snapshots.RUnlock()
+
+	p := &Pairs{NodeInternalName: n.InternalName()}
+	for next := []byte{}; next != nil; {
+		p.Data = p.Data[:0]
+		start := next
+		next = nil
+		if err := n.db.Seek(start, func(k, v []byte) int {
+			if bytes.Equal(k, internalNodeName) {
+				return driver.SeekNext
+			}
+			if len(p.Data) >= snapshotChunk {
+				next = append([]byte{}, k...)
+				return driver.SeekAbort
+			}
+			p.Data = append(p.Data, Pair{append([]byte{}, k...), append([]byte{}, v...)})
+			return driver.SeekNext
+		}); err != nil {
+			return err
+		}
+		if len(p.Data) == 0 {
+			break
+		}
+		buf, _ := proto.Marshal(p)
+		if err := writeChunk(w, buf); err != nil {
+			return err
+		}
+	}
+	return writeChunk(w, nil)
+}
+
+func writeChunk(w io.Writer, buf []byte) error {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	if _, err := w.Write(tmp[:binary.PutUvarint(tmp, uint64(len(buf)))]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// Bootstrap seeds the node with the snapshot of the peer (a peer name or its address),
+// and sets replication checkpoints accordingly. The node should be brand new
+func (n *Node) Bootstrap(peer string) error {
+	if n.log.Size() > 0 {
+		return fmt.Errorf("bootstrap: node is not empty")
+	}
+
+	n.friends.Lock()
+	addr := n.friends.contacts[peer]
+	n.friends.Unlock()
+	if addr == "" {
+		addr = strings.TrimSuffix(peer, "/")
+	}
+
+	// The transfer may take a long time, no timeout here
+	client := &http.Client{Transport: n.client.Transport}
+	resp, err := client.Get(n.signedURL("GET", addr+"/snapshot", url.Values{}, nil))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("X-Error") != "" {
+		return fmt.Errorf("bootstrap: %s", resp.Header.Get("X-Msg"))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bootstrap: %s", resp.Status)
+	}
+
+	cps := map[string]int64{}
+	if err := json.Unmarshal([]byte(resp.Header.Get("X-Snapshot-Checkpoints")), &cps); err != nil {
+		return fmt.Errorf("bootstrap: invalid checkpoints: %v", err)
+	}
+
+	rd, total := bufio.NewReader(resp.Body), 0
+	for {
+		ln, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return fmt.Errorf("bootstrap: %v", err)
+		}
+		if ln == 0 {
+			break
+		}
+		buf := make([]byte, ln)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return fmt.Errorf("bootstrap: %v", err)
+		}
+
+		p := &Pairs{}
+		if err := proto.Unmarshal(buf, p); err != nil {
+			return fmt.Errorf("bootstrap: %v", err)
+		}
+		keys, kvs := make([][]byte, 0, len(p.Data)), make([][]byte, 0, len(p.Data)*2)
+		for _, pair := range p.Data {
+			if idx := bytes.IndexByte(pair.Key, 0); idx == -1 || len(pair.Key[idx:]) != 16 {
+				return fmt.Errorf("bootstrap: invalid key: %q", pair.Key)
+			}
+			keys = append(keys, pair.Key)
+			kvs = append(kvs, pair.Key, pair.Value)
+		}
+		// Logged like replicated pairs, so peers bootstrapped or replicating from us get them as well
+		if _, err := n.log.Append(keys, func([]int64) error {
+			return n.db.Put(kvs...)
+		}); err != nil {
+			return err
+		}
+		total += len(p.Data)
+	}
+
+	updated := ""
+	n.friends.Lock()
+	for name, cp := range cps {
+		if f := n.friends.states[name]; f != nil && cp > f.Checkpoint {
+			f.Checkpoint, updated = cp, name
+		}
+	}
+	n.friends.Unlock()
+	if updated != "" {
+		n.writeRepState(updated)
+	}
+
+	log.Println("bootstrap: seeded", total, "versions from", addr, "checkpoints:", cps)
+	return nil
+}
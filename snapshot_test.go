@@ -0,0 +1,77 @@
+package gouch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/coyove/gouch/clock"
+)
+
+func TestBootstrap(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	a := testNode(t, Options{Driver: "memory", Name: "a", Mux: mux})
+	defer closeTestNode(a)
+
+	for i := 0; i < snapshotChunk*2+10; i++ {
+		a.Put(strconv.Itoa(i), []byte(strconv.Itoa(i)), false)
+	}
+	a.Put("x", []byte("1"), false)
+	a.Put("x", []byte("2"), true)
+
+	// A version from a peer whose clock is ahead of ours
+	skewed := make([]byte, 8)
+	binary.BigEndian.PutUint64(skewed, uint64(clock.Timestamp()+60<<20))
+	skewed = append(append([]byte("skew"), skewed...), "peer0001"...)
+	if err := a.PutKeyParis([]Pair{{Key: skewed, Value: []byte("v")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := testNode(t, Options{
+		Driver:        "memory",
+		Name:          "b",
+		Peers:         "http://a@" + srv.Listener.Addr().String(),
+		BootstrapFrom: "a",
+	})
+	defer closeTestNode(b)
+
+	for i := 0; i < snapshotChunk*2+10; i += 100 {
+		if e, err := b.Get(strconv.Itoa(i)); err != nil || e.Value != strconv.Itoa(i) {
+			t.Fatal(i, e, err)
+		}
+	}
+	if e, err := b.Get("x"); err != nil || e.Value != "12" {
+		t.Fatal(e, err)
+	}
+	if k, _, err := b.db.Get(skewed); err != nil || !bytes.Equal(k, skewed) {
+		t.Fatal("skewed version lost:", k, err)
+	}
+
+	b.friends.Lock()
+	cp := b.friends.states["a"].Checkpoint
+	b.friends.Unlock()
+	if cp <= 0 {
+		t.Fatal(cp)
+	}
+	if b.log.Size() == 0 {
+		t.Fatal("snapshot not logged")
+	}
+	b.Put("y", nil, false)
+	if err := b.Bootstrap("a"); err == nil {
+		t.Fatal("bootstrap a non-empty node")
+	}
+
+	bad := httptest.NewServer(http.NotFoundHandler())
+	defer bad.Close()
+	c := testNode(t, Options{Driver: "memory", Name: "c"})
+	defer closeTestNode(c)
+	if err := c.Bootstrap(bad.URL); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,98 @@
+package gouch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a certificate signed by parent (self-signed if nil) into dir/name.crt and dir/name.key
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0644)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gouch")
+	defer os.RemoveAll(dir)
+	ca, cakey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "a", ca, cakey)
+	writeTestCert(t, dir, "b", ca, cakey)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	cfg, err := ServerTLSConfig(path("a.crt"), path("a.key"), path("ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	a := testNode(t, Options{Driver: "memory", Name: "a", Mux: mux})
+	defer closeTestNode(a)
+	a.Put("k", []byte("v"), false)
+
+	peerTLS, err := PeerTLSConfig(path("ca.crt"), path("b.crt"), path("b.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := testNode(t, Options{
+		Driver:  "memory",
+		Name:    "b",
+		Peers:   "https://a@" + srv.Listener.Addr().String(),
+		PeerTLS: peerTLS,
+	})
+	defer closeTestNode(b)
+
+	for i := 0; ; i++ {
+		if e, err := b.Get("k"); err == nil && e.Value == "v" {
+			break
+		}
+		if i > 100 {
+			t.Fatal("not replicated")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Clients without certificates are rejected
+	noCert, _ := PeerTLSConfig(path("ca.crt"), "", "")
+	if _, err := newPeerClient(noCert).Get(srv.URL + "/replicate"); err == nil {
+		t.Fatal("client certificate not verified")
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package gouch
 
 import (
 	"encoding/base64"
@@ -28,6 +28,23 @@ type Pair struct {
 	Value []byte `protobuf:"bytes,2,rep" json:"value"`
 }
 
+type BatchOp struct {
+	Key    string `protobuf:"bytes,1,opt" json:"key"`
+	Value  string `protobuf:"bytes,2,opt" json:"value,omitempty"`
+	Append bool   `protobuf:"varint,3,opt" json:"append,omitempty"`
+	Delete bool   `protobuf:"varint,4,opt" json:"delete,omitempty"`
+}
+
+type Batch struct {
+	Ops []BatchOp `protobuf:"bytes,1,rep" json:"ops"`
+}
+
+func (p *Batch) Reset() { *p = Batch{} }
+
+func (p *Batch) String() string { return proto.CompactTextString(p) }
+
+func (p *Batch) ProtoMessage() {}
+
 func getKeyBounds(key string, startTimestamp int64) (lower []byte, upper []byte) {
 	lower = append([]byte(key),
 		0, 0, 0, 0, 0, 0, 0, 0,
@@ -42,6 +59,10 @@ func getKeyBounds(key string, startTimestamp int64) (lower []byte, upper []byte)
 }
 
 func writeJSON(w http.ResponseWriter, r *http.Request, kvs ...interface{}) {
+	writeJSONCode(w, r, http.StatusOK, kvs...)
+}
+
+func writeJSONCode(w http.ResponseWriter, r *http.Request, code int, kvs ...interface{}) {
 	w.Header().Add("X-Server", "gouch")
 
 	m := map[string]interface{}{}
@@ -57,6 +78,7 @@ func writeJSON(w http.ResponseWriter, r *http.Request, kvs ...interface{}) {
 	}
 
 	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
 	w.Write(buf)
 }
 